@@ -16,10 +16,20 @@ package config
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image/color"
+	"math"
+	"net"
+	"net/url"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -428,3 +438,3378 @@ func TestParseMap(t *testing.T) {
 
 	t.Log(conf)
 }
+
+func TestParseFloat(t *testing.T) {
+	type Tconf struct {
+		Ratio float64 `config:"math-ratio"`
+		Scale float32 `config:"math-scale"`
+		Unset float64 `config:"math-unset"`
+	}
+	c := NewDefault()
+	c.AddOption("math", "ratio", "3.14")
+	c.AddOption("math", "scale", "0.5")
+
+	conf := &Tconf{Unset: 1.5}
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Ratio != 3.14 {
+		t.Errorf("Ratio: expected 3.14, got %v", conf.Ratio)
+	}
+	if conf.Scale != 0.5 {
+		t.Errorf("Scale: expected 0.5, got %v", conf.Scale)
+	}
+	if conf.Unset != 1.5 {
+		t.Errorf("Unset: missing option overwrote field, got %v", conf.Unset)
+	}
+}
+
+func TestParseMalformedTag(t *testing.T) {
+	type Tconf struct {
+		Host string `config:"justsection"`
+	}
+	c := NewDefault()
+	c.AddOption("justsection", "host", "localhost")
+
+	err := c.ParseConf(new(Tconf))
+	if err == nil {
+		t.Fatal("ParseConf failure: no error for a tag without option")
+	}
+	if !strings.Contains(err.Error(), "justsection") || !strings.Contains(err.Error(), "Host") {
+		t.Errorf("ParseConf failure: error does not name the tag and field: %s", err)
+	}
+}
+
+func TestParseTagDelimiter(t *testing.T) {
+	type Tconf struct {
+		Timeout  int    `config:"my-service:timeout"`
+		PoolSize int    `config:"db-pool-size"`
+		MaxIdle  int    `config:"db:max-idle"`
+		Plugin   string `config:"plugin:auth:name"`
+	}
+	c := NewDefault()
+	c.AddOption("my-service", "timeout", "30")
+	c.AddOption("db", "pool-size", "10")
+	c.AddOption("db", "max-idle", "2")
+	c.AddOption("plugin:auth", "name", "ldap")
+
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Timeout != 30 {
+		t.Errorf("Timeout: expected 30, got %d", conf.Timeout)
+	}
+	if conf.PoolSize != 10 {
+		t.Errorf("PoolSize: expected 10, got %d", conf.PoolSize)
+	}
+	if conf.MaxIdle != 2 {
+		t.Errorf("MaxIdle: expected 2, got %d", conf.MaxIdle)
+	}
+	if conf.Plugin != "ldap" {
+		t.Errorf("Plugin: expected ldap, got %q", conf.Plugin)
+	}
+}
+
+// TestParseQuiet checks that ParseConf does not write to stdout.
+func TestParseQuiet(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+
+	type Tconf struct {
+		Host   string            `config:"rabbit-host"`
+		Rabbit map[string]string `config:"rabbit"`
+		Ids    []int             `config:"debug-ids"`
+	}
+	c := NewDefault()
+	c.AddOption("rabbit", "host", "localhost")
+	c.AddOption("debug", "ids", "1,2")
+	err = c.ParseConf(new(Tconf))
+
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make([]byte, 64)
+	if n, _ := r.Read(out); n != 0 {
+		t.Errorf("ParseConf failure: wrote to stdout: %q", out[:n])
+	}
+	r.Close()
+}
+
+func TestDuration(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "base_timeout", "30s")
+	c.AddOption("net", "timeout", "%(base_timeout)s")
+	c.AddOption("net", "retry", "1m30s")
+	c.AddOption("net", "bad", "soon")
+
+	if d, err := c.Duration("net", "timeout"); err != nil || d != 30*time.Second {
+		t.Errorf("Duration failure: expected 30s, got %v (%v)", d, err)
+	}
+	if _, err := c.Duration("net", "bad"); err == nil {
+		t.Errorf("Duration failure: no error for malformed value")
+	}
+
+	type Tconf struct {
+		Retry time.Duration `config:"net:retry"`
+	}
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Retry != 90*time.Second {
+		t.Errorf("Retry: expected 1m30s, got %v", conf.Retry)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	type Tconf struct {
+		Start time.Time `config:"job:start"`
+		Day   time.Time `config:"job:day" layout:"2006-01-02"`
+		Bad   time.Time `config:"bad:start"`
+	}
+	c := NewDefault()
+	c.AddOption("job", "start", "2024-01-02T15:04:05Z")
+	c.AddOption("job", "day", "2024-03-04")
+
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC); !conf.Start.Equal(want) {
+		t.Errorf("Start: expected %v, got %v", want, conf.Start)
+	}
+	if want := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC); !conf.Day.Equal(want) {
+		t.Errorf("Day: expected %v, got %v", want, conf.Day)
+	}
+
+	c.AddOption("bad", "start", "yesterday")
+	err := c.ParseConf(new(Tconf))
+	if err == nil {
+		t.Fatal("ParseConf failure: no error for malformed time")
+	}
+	for _, s := range []string{"bad", "start", time.RFC3339} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("ParseConf failure: error does not mention %q: %s", s, err)
+		}
+	}
+}
+
+func TestParseDefault(t *testing.T) {
+	type Tconf struct {
+		Host  string        `config:"server:host" default:"localhost"`
+		Port  int           `config:"server:port" default:"8080"`
+		Debug bool          `config:"server:debug" default:"on"`
+		Ratio float64       `config:"server:ratio" default:"0.25"`
+		Wait  time.Duration `config:"server:wait" default:"5s"`
+		Ids   []int         `config:"server:ids" default:"1,2,3"`
+	}
+	c := NewDefault()
+	c.AddOption("server", "host", "example.com")
+
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Host != "example.com" {
+		t.Errorf("Host: present option lost to default, got %q", conf.Host)
+	}
+	if conf.Port != 8080 || !conf.Debug || conf.Ratio != 0.25 || conf.Wait != 5*time.Second {
+		t.Errorf("ParseConf failure: defaults not applied: %+v", conf)
+	}
+	if !reflect.DeepEqual(conf.Ids, []int{1, 2, 3}) {
+		t.Errorf("Ids: expected [1 2 3], got %v", conf.Ids)
+	}
+
+	type Tbad struct {
+		Port int `config:"server:port" default:"eighty"`
+	}
+	err := c.ParseConf(new(Tbad))
+	if err == nil || !strings.Contains(err.Error(), "eighty") {
+		t.Errorf("ParseConf failure: invalid default not reported: %v", err)
+	}
+}
+
+func TestParseRequired(t *testing.T) {
+	type Tconf struct {
+		User     string `config:"db:user"`
+		Password string `config:"db:password" required:"true"`
+	}
+	c := NewDefault()
+	c.AddOption("db", "user", "admin")
+
+	err := c.ParseConf(new(Tconf))
+	if err == nil {
+		t.Fatal("ParseConf failure: no error for missing required option")
+	}
+	if !strings.Contains(err.Error(), "[db] password") {
+		t.Errorf("ParseConf failure: error does not name the option: %s", err)
+	}
+
+	c.AddOption("db", "password", "secret")
+	conf := new(Tconf)
+	if err = c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Password != "secret" {
+		t.Errorf("Password: expected secret, got %q", conf.Password)
+	}
+}
+
+func TestParseUint(t *testing.T) {
+	type Tconf struct {
+		N uint64 `config:"num:n"`
+	}
+	for _, tc := range []struct {
+		v    string
+		want uint64
+		ok   bool
+	}{
+		{"42", 42, true},
+		{"18446744073709551615", 18446744073709551615, true}, // larger than int64
+		{"18446744073709551616", 0, false},
+		{"-1", 0, false},
+	} {
+		c := NewDefault()
+		c.AddOption("num", "n", tc.v)
+		conf := new(Tconf)
+		err := c.ParseConf(conf)
+		if tc.ok && (err != nil || conf.N != tc.want) {
+			t.Errorf("ParseConf failure for %q: expected %d, got %d (%v)", tc.v, tc.want, conf.N, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("ParseConf failure for %q: no error, got %d", tc.v, conf.N)
+		}
+	}
+}
+
+func TestInt64(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("num", "big", "5000000000")
+
+	if v, err := c.Int64("num", "big"); err != nil || v != 5000000000 {
+		t.Errorf("Int64 failure: expected 5000000000, got %d (%v)", v, err)
+	}
+
+	type Tconf struct {
+		Big int64 `config:"num:big"`
+	}
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Big != 5000000000 {
+		t.Errorf("Big: expected 5000000000, got %d", conf.Big)
+	}
+}
+
+func TestParseSliceSep(t *testing.T) {
+	type Tconf struct {
+		Tags  []string `config:"app:tags" sep:";"`
+		Hosts []string `config:"app:hosts"`
+	}
+	c := NewDefault()
+	c.AddOption("app", "tags", "red; green; blue")
+	c.AddOption("app", "hosts", "a, b,c")
+
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"red", "green", "blue"}; !reflect.DeepEqual(conf.Tags, want) {
+		t.Errorf("Tags: expected %q, got %q", want, conf.Tags)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(conf.Hosts, want) {
+		t.Errorf("Hosts: expected %q, got %q", want, conf.Hosts)
+	}
+}
+
+func TestParseSliceTrim(t *testing.T) {
+	type Tconf struct {
+		Ids []int `config:"app:ids"`
+	}
+	for v, want := range map[string][]int{
+		"1, 2, 3":   {1, 2, 3},
+		" 1 ,2 , 3": {1, 2, 3},
+		"1,2,3,":    {1, 2, 3},
+		"1,,2":      {1, 2},
+	} {
+		c := NewDefault()
+		c.AddOption("app", "ids", v)
+		conf := new(Tconf)
+		if err := c.ParseConf(conf); err != nil {
+			t.Errorf("ParseConf failure for %q: %s", v, err)
+			continue
+		}
+		if !reflect.DeepEqual(conf.Ids, want) {
+			t.Errorf("Ids for %q: expected %v, got %v", v, want, conf.Ids)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "name", "world")
+	c.AddOption("s", "flag", "yes")
+	c.AddOption("s", "one", "1")
+	c.AddOption("s", "count", "42")
+	c.AddOption("s", "ratio", "0.5")
+	c.AddOption("s", "greeting", "hello %(name)s")
+
+	for opt, want := range map[string]interface{}{
+		"flag":     true,
+		"one":      true,
+		"count":    int64(42),
+		"ratio":    0.5,
+		"greeting": "hello world",
+	} {
+		v, err := c.Get("s", opt)
+		if err != nil || v != want {
+			t.Errorf("Get failure for %s: expected %#v, got %#v (%v)", opt, want, v, err)
+		}
+	}
+	if _, err := c.Get("s", "missing"); err == nil {
+		t.Errorf("Get failure: no error for missing option")
+	}
+}
+
+// TestConcurrent reads options while they are being written; run with -race.
+func TestConcurrent(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("s", "n", "0")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := c.Int("s", "n"); err != nil {
+					t.Error(err)
+					return
+				}
+				c.Bool("s", "flag")
+				c.Float("s", "n")
+				c.RawString("s", "n")
+				c.Options("s")
+				c.Sections()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			c.AddOption("s", "n", "1")
+			c.AddOption("s", "flag", "on")
+			c.AddSection("t")
+			c.RemoveSection("t")
+		}
+	}()
+	wg.Wait()
+}
+
+// TestSections tests enumerating the sections in input order.
+func TestSections(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("worker-2", "n", "2")
+	c.AddOption("worker-1", "n", "1")
+	c.AddSection("worker-3")
+
+	want := []string{DEFAULT_SECTION, "worker-2", "worker-1", "worker-3"}
+	if got := c.Sections(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Sections failure: expected %q, got %q", want, got)
+	}
+	for _, s := range want {
+		if !c.HasSection(s) {
+			t.Errorf("HasSection failure: missing %s", s)
+		}
+	}
+}
+
+// TestOptionsSorted tests that option lists are returned sorted.
+func TestOptionsSorted(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "b", "1")
+	c.AddOption("s", "c", "1")
+	c.AddOption("s", "a", "1")
+	c.AddOption("s", "b", "2")
+
+	options, err := c.Options("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(options, want) {
+		t.Errorf("Options failure: expected %q, got %q", want, options)
+	}
+
+	c.AddOption(DEFAULT_SECTION, "d", "1")
+	options, err = c.SectionOptions("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(options, want) {
+		t.Errorf("SectionOptions failure: expected %q, got %q", want, options)
+	}
+}
+
+// TestHasOption tests that HasOption agrees with RawString.
+func TestHasOption(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "host", "example.com")
+	c.AddOption("s", "port", "%(missing)s")
+
+	for _, tc := range []struct {
+		section, option string
+	}{
+		{"s", "port"}, {"s", "host"}, {"no-section", "host"}, {"s", "none"}, {"no-section", "port"},
+	} {
+		_, err := c.RawString(tc.section, tc.option)
+		if got := c.HasOption(tc.section, tc.option); got != (err == nil) {
+			t.Errorf("HasOption failure for %s %s: got %v, RawString error %v",
+				tc.section, tc.option, got, err)
+		}
+	}
+}
+
+// TestWriteTo tests that writing and parsing again yields the same values.
+func TestWriteTo(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "host", "www.example.com")
+	c.AddOption("service", "url", "http://%(host)s/path")
+	c.AddOption("service", "comments", "line1\nline2")
+	c.AddOption("other", "n", "1")
+
+	var buf bytes.Buffer
+	n, err := c.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo failure: reported %d bytes, wrote %d", n, buf.Len())
+	}
+
+	cr := NewDefault()
+	if err = cr.read(bufio.NewReader(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cr.Sections(), c.Sections()) {
+		t.Errorf("WriteTo failure: sections %q, expected %q", cr.Sections(), c.Sections())
+	}
+	for _, section := range c.Sections() {
+		options, _ := c.SectionOptions(section)
+		for _, option := range options {
+			want, _ := c.RawString(section, option)
+			if got, _ := cr.RawString(section, option); got != want {
+				t.Errorf("WriteTo failure: [%s] %s is %q, expected %q", section, option, got, want)
+			}
+		}
+	}
+}
+
+func TestSetOption(t *testing.T) {
+	c := NewDefault()
+
+	if err := c.SetOption("new-section", "option", "value"); err != nil {
+		t.Fatalf("SetOption failure: %s", err)
+	}
+	if !c.HasSection("new-section") {
+		t.Errorf("SetOption failure: section not created")
+	}
+	testGet(t, c, "new-section", "option", "value")
+
+	for _, option := range []string{"", "  ", " a", "a\t", "a=b", "a:b", "a\nb", "#x", ";x", "[y",
+		"a #b", "a ;b", "a\t#b", `a\#b`} {
+		if err := c.SetOption("new-section", option, "value"); err == nil {
+			t.Errorf("SetOption failure: no error for option name %q", option)
+		}
+	}
+
+	// Only the comment characters in use are rejected.
+	c.CommentChars = "!"
+	if err := c.SetOption("new-section", "#x", "value"); err != nil {
+		t.Errorf("SetOption failure: %s", err)
+	}
+}
+
+// TestRemoveDefault tests removing from the default section.
+func TestRemoveDefault(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("", "a", "1")
+	c.AddOption(DEFAULT_SECTION, "b", "2")
+
+	if !c.RemoveOption("", "a") {
+		t.Errorf("RemoveOption failure: false for default option via empty section")
+	}
+	if !c.RemoveOption(DEFAULT_SECTION, "b") {
+		t.Errorf("RemoveOption failure: false for default option")
+	}
+	if c.HasOption(DEFAULT_SECTION, "a") || c.HasOption(DEFAULT_SECTION, "b") {
+		t.Errorf("RemoveOption failure: default options still present")
+	}
+	if c.RemoveSection(DEFAULT_SECTION) || !c.HasSection(DEFAULT_SECTION) {
+		t.Errorf("RemoveSection failure: removed the default section")
+	}
+}
+
+func TestGetDefault(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("s", "name", "svc")
+	c.AddOption("s", "n", "7")
+	c.AddOption("s", "flag", "on")
+	c.AddOption("s", "ratio", "0.5")
+	c.AddOption("s", "wait", "2s")
+	c.AddOption("s", "bad", "x")
+	c.AddOption("s", "cycle", "%(cycle)s")
+
+	check := func(what string, got, want interface{}, err error) {
+		if err != nil || got != want {
+			t.Errorf("%s failure: expected %v, got %v (%v)", what, want, got, err)
+		}
+	}
+
+	// present
+	v, err := c.StringDefault("s", "name", "def")
+	check("StringDefault", v, "svc", err)
+	i, err := c.IntDefault("s", "n", 1)
+	check("IntDefault", i, 7, err)
+	b, err := c.BoolDefault("s", "flag", false)
+	check("BoolDefault", b, true, err)
+	f, err := c.FloatDefault("s", "ratio", 1)
+	check("FloatDefault", f, 0.5, err)
+	d, err := c.DurationDefault("s", "wait", time.Second)
+	check("DurationDefault", d, 2*time.Second, err)
+
+	// missing
+	v, err = c.StringDefault("s", "missing", "def")
+	check("StringDefault", v, "def", err)
+	i, err = c.IntDefault("s", "missing", 1)
+	check("IntDefault", i, 1, err)
+	b, err = c.BoolDefault("s", "missing", true)
+	check("BoolDefault", b, true, err)
+	f, err = c.FloatDefault("s", "missing", 1.5)
+	check("FloatDefault", f, 1.5, err)
+	d, err = c.DurationDefault("s", "missing", time.Second)
+	check("DurationDefault", d, time.Second, err)
+
+	// malformed
+	i, err = c.IntDefault("s", "bad", 1)
+	check("IntDefault", i, 1, err)
+	b, err = c.BoolDefault("s", "bad", true)
+	check("BoolDefault", b, true, err)
+	f, err = c.FloatDefault("s", "bad", 1.5)
+	check("FloatDefault", f, 1.5, err)
+	d, err = c.DurationDefault("s", "bad", time.Second)
+	check("DurationDefault", d, time.Second, err)
+
+	// unfolding errors are not swallowed
+	if _, err = c.StringDefault("s", "cycle", "def"); err == nil {
+		t.Errorf("StringDefault failure: no error for cycle")
+	}
+	if _, err = c.IntDefault("s", "cycle", 1); err == nil {
+		t.Errorf("IntDefault failure: no error for cycle")
+	}
+}
+
+func TestRegisterBoolValues(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("s", "a", "Enabled")
+	c.AddOption("s", "b", "disabled")
+	c.AddOption("s", "c", "on")
+	c.AddOption("s", "d", "off")
+
+	if _, err := c.Bool("s", "a"); err == nil {
+		t.Errorf("Bool failure: accepted unregistered value")
+	}
+
+	c.RegisterBoolValues([]string{"enabled"}, []string{"DISABLED"})
+	testGet(t, c, "s", "a", true)
+	testGet(t, c, "s", "b", false)
+	testGet(t, c, "s", "c", true)
+	testGet(t, c, "s", "d", false)
+
+	// Other configurations keep the default set.
+	other := NewDefault()
+	other.AddOption("s", "a", "enabled")
+	if _, err := other.Bool("s", "a"); err == nil {
+		t.Errorf("Bool failure: registered value leaked to another Config")
+	}
+}
+
+func TestParseSectionMap(t *testing.T) {
+	type Tconf struct {
+		Env    map[string]string `config:"env"`
+		Limits map[string]int    `config:"limits:"`
+		Ports  map[int]bool      `config:"ports"`
+		None   map[string]string `config:"none"`
+	}
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "home", "/home/user")
+	c.AddOption("env", "PATH", "/bin")
+	c.AddOption("env", "HOME", "%(home)s")
+	c.AddOption("limits", "api", "100")
+	c.AddOption("ports", "80", "on")
+
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"PATH": "/bin", "HOME": "/home/user"}; !reflect.DeepEqual(conf.Env, want) {
+		t.Errorf("Env: expected %v, got %v", want, conf.Env)
+	}
+	if want := map[string]int{"api": 100}; !reflect.DeepEqual(conf.Limits, want) {
+		t.Errorf("Limits: expected %v, got %v", want, conf.Limits)
+	}
+	if want := map[int]bool{80: true}; !reflect.DeepEqual(conf.Ports, want) {
+		t.Errorf("Ports: expected %v, got %v", want, conf.Ports)
+	}
+	if conf.None != nil {
+		t.Errorf("None: expected nil for missing section, got %v", conf.None)
+	}
+
+	type Trequired struct {
+		None map[string]string `config:"none" required:"true"`
+	}
+	if err := c.ParseConf(new(Trequired)); err == nil {
+		t.Errorf("ParseConf failure: no error for missing required section")
+	}
+}
+
+func TestParsePointer(t *testing.T) {
+	type Tconf struct {
+		Port  *int    `config:"server:port"`
+		Host  *string `config:"server:host"`
+		Debug *bool   `config:"server:debug"`
+	}
+	c := NewDefault()
+	c.AddOption("server", "port", "0")
+
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Port == nil || *conf.Port != 0 {
+		t.Errorf("Port: expected pointer to 0, got %v", conf.Port)
+	}
+	if conf.Host != nil || conf.Debug != nil {
+		t.Errorf("ParseConf failure: missing options allocated pointers: %v %v", conf.Host, conf.Debug)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	c := NewWithOptions(true)
+	c.AddOption("Database", "Host", "db1")
+	c.AddOption("database", "PORT", "5432")
+	c.AddOption("default", "User", "admin")
+	c.AddOption("DATABASE", "url", "%(HOST)s:%(port)s")
+
+	testGet(t, c, "DATABASE", "host", "db1")
+	testGet(t, c, "database", "Port", 5432)
+	testGet(t, c, "database", "user", "admin")
+	testGet(t, c, "Database", "URL", "db1:5432")
+
+	if want := []string{DEFAULT_SECTION, "database"}; !reflect.DeepEqual(c.Sections(), want) {
+		t.Errorf("Sections failure: expected %q, got %q", want, c.Sections())
+	}
+	if !c.HasOption("DataBase", "hOst") {
+		t.Errorf("HasOption failure: mixed case not found")
+	}
+
+	// The last write wins among names that only differ in case.
+	c.AddOption("database", "HOST", "db2")
+	testGet(t, c, "database", "host", "db2")
+
+	if !c.RemoveSection("DATABASE") || c.HasSection("database") {
+		t.Errorf("RemoveSection failure: mixed case not removed")
+	}
+
+	// The default mode stays case-sensitive.
+	s := NewDefault()
+	s.AddOption("Database", "Host", "db1")
+	if s.HasOption("database", "host") {
+		t.Errorf("HasOption failure: case-insensitive match in default mode")
+	}
+}
+
+func TestCycleChain(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("s", "a", "x %(b)s")
+	c.AddOption("s", "b", "y %(a)s")
+	c.AddOption("s", "twice", "%(leaf)s and %(leaf)s")
+	c.AddOption("s", "leaf", "v")
+
+	_, err := c.String("s", "a")
+	if err == nil {
+		t.Fatal("String failure: no error for cycle")
+	}
+	if !strings.Contains(err.Error(), "a -> b -> a") {
+		t.Errorf("String failure: cycle chain not reported: %s", err)
+	}
+
+	// Referencing the same option twice is not a cycle.
+	testGet(t, c, "s", "twice", "v and v")
+}
+
+func TestMaxUnfoldDepth(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("s", "a", "%(b)s")
+	c.AddOption("s", "b", "%(c)s")
+	c.AddOption("s", "c", "%(d)s")
+	c.AddOption("s", "d", "v")
+
+	c.MaxUnfoldDepth = 2
+	if _, err := c.String("s", "a"); err == nil {
+		t.Errorf("String failure: 3 levels unfolded with a depth of 2")
+	}
+
+	c.MaxUnfoldDepth = 3
+	testGet(t, c, "s", "a", "v")
+
+	c.MaxUnfoldDepth = -1 // falls back to _DEPTH_VALUES
+	testGet(t, c, "s", "a", "v")
+}
+
+func TestEscapedVariables(t *testing.T) {
+	os.Setenv("GO_CONFIGFILE_TEST_ESCAPE", "value")
+	c := NewDefault()
+	c.AddOption("s", "name", "world")
+	c.AddOption("s", "format", "%%(name)s is %(name)s")
+	c.AddOption("s", "shell", "$$HOME and $${GO_CONFIGFILE_TEST_ESCAPE} is ${GO_CONFIGFILE_TEST_ESCAPE}")
+	c.AddOption("s", "nested", "[%(format)s]")
+
+	testGet(t, c, "s", "format", "%(name)s is world")
+	testGet(t, c, "s", "shell", "$HOME and ${GO_CONFIGFILE_TEST_ESCAPE} is value")
+	testGet(t, c, "s", "nested", "[%(name)s is world]")
+
+	// The raw value keeps the escapes.
+	if v, _ := c.RawString("s", "format"); v != "%%(name)s is %(name)s" {
+		t.Errorf("RawString failure: escape not kept: %q", v)
+	}
+}
+
+func TestSliceGetters(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "main", "web1")
+	c.AddOption("s", "hosts", "%(main)s, web2 ,web3,")
+	c.AddOption("s", "ports", "80; 443")
+	c.AddOption("s", "ratios", "0.5,1.5")
+	c.AddOption("s", "bad", "1,x")
+
+	hosts, err := c.StringSlice("s", "hosts", "")
+	if want := []string{"web1", "web2", "web3"}; err != nil || !reflect.DeepEqual(hosts, want) {
+		t.Errorf("StringSlice failure: expected %q, got %q (%v)", want, hosts, err)
+	}
+	ports, err := c.IntSlice("s", "ports", ";")
+	if want := []int{80, 443}; err != nil || !reflect.DeepEqual(ports, want) {
+		t.Errorf("IntSlice failure: expected %v, got %v (%v)", want, ports, err)
+	}
+	ratios, err := c.FloatSlice("s", "ratios", ",")
+	if want := []float64{0.5, 1.5}; err != nil || !reflect.DeepEqual(ratios, want) {
+		t.Errorf("FloatSlice failure: expected %v, got %v (%v)", want, ratios, err)
+	}
+	if _, err = c.IntSlice("s", "bad", ""); err == nil {
+		t.Errorf("IntSlice failure: no error for malformed element")
+	}
+	if _, err = c.StringSlice("s", "missing", ""); err == nil {
+		t.Errorf("StringSlice failure: no error for missing option")
+	}
+}
+
+func TestParseSections(t *testing.T) {
+	type Server struct {
+		Host string `config:":host"`
+		Port int    `config:":port" default:"80"`
+	}
+	type Tconf struct {
+		Servers []Server `config:"server*:"`
+		None    []Server `config:"none*:"`
+	}
+	c := NewDefault()
+	c.AddOption("server3", "host", "c")
+	c.AddOption("server1", "host", "a")
+	c.AddOption("server1", "port", "8080")
+	c.AddOption("server2", "host", "b")
+	c.AddOption("other", "host", "x")
+
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	want := []Server{{"a", 8080}, {"b", 80}, {"c", 80}}
+	if !reflect.DeepEqual(conf.Servers, want) {
+		t.Errorf("Servers: expected %v, got %v", want, conf.Servers)
+	}
+	if conf.None != nil {
+		t.Errorf("None: expected nil without matching sections, got %v", conf.None)
+	}
+
+	type Tbad struct {
+		Host string `config:":host"`
+	}
+	if err := c.ParseConf(new(Tbad)); err == nil {
+		t.Errorf("ParseConf failure: no error for a tag without section at the top level")
+	}
+}
+
+func TestParseAllErrors(t *testing.T) {
+	type Tconf struct {
+		Port  int     `config:"server:port"`
+		Debug bool    `config:"server:debug"`
+		Host  string  `config:"server:host"`
+		Ratio float64 `config:"server:ratio"`
+	}
+	c := NewDefault()
+	c.AddOption("server", "port", "eighty")
+	c.AddOption("server", "debug", "maybe")
+	c.AddOption("server", "host", "localhost")
+	c.AddOption("server", "ratio", "half")
+
+	conf := new(Tconf)
+	err := c.ParseConf(conf)
+	if err == nil {
+		t.Fatal("ParseConf failure: no error for malformed values")
+	}
+	for _, s := range []string{"[server] port", "[server] debug", "[server] ratio"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("ParseConf failure: error does not mention %s: %s", s, err)
+		}
+	}
+	if conf.Host != "localhost" {
+		t.Errorf("Host: not loaded after an earlier error, got %q", conf.Host)
+	}
+
+	if err = c.ParseConf(new(struct {
+		Host string `config:"server:host"`
+	})); err != nil {
+		t.Errorf("ParseConf failure: %s", err)
+	}
+}
+
+func TestFieldError(t *testing.T) {
+	type Tconf struct {
+		Port  int      `config:"server:port"`
+		Queue chan int `config:"server:queue"`
+		Debug bool     `config:"server:debug"`
+	}
+	c := NewDefault()
+	c.AddOption("server", "port", "eighty")
+	c.AddOption("server", "queue", "10")
+	c.AddOption("server", "debug", "on")
+
+	err := c.ParseConf(new(Tconf))
+	var fe *FieldError
+	if !errors.As(err, &fe) {
+		t.Fatalf("ParseConf failure: no FieldError in %v", err)
+	}
+	if fe.Section != "server" || fe.Option != "port" || fe.Kind != reflect.Int {
+		t.Errorf("FieldError failure: got %+v", fe)
+	}
+	var ne *strconv.NumError
+	if !errors.As(fe, &ne) {
+		t.Errorf("FieldError failure: cause not kept: %v", fe.Err)
+	}
+	if !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("ParseConf failure: unsupported type not reported: %v", err)
+	}
+	if want := `could not load [server] port: strconv.ParseInt: parsing "eighty": invalid syntax`; fe.Error() != want {
+		t.Errorf("FieldError failure: message %q, expected %q", fe.Error(), want)
+	}
+}
+
+// TestMergeOverlay tests overlaying an override configuration onto a base.
+func TestMergeOverlay(t *testing.T) {
+	base := NewDefault()
+	base.AddOption(DEFAULT_SECTION, "env", "dev")
+	base.AddOption("db", "host", "base")
+	base.AddOption("db", "port", "5432")
+	base.AddOption("cache", "size", "10")
+
+	override := NewDefault()
+	override.AddOption(DEFAULT_SECTION, "env", "prod")
+	override.AddOption("db", "host", "override")
+	override.AddOption("db", "user", "app")
+	override.AddOption("db", "pool", "5")
+	override.AddSection("empty")
+
+	base.Merge(override)
+
+	testGet(t, base, "db", "host", "override")
+	testGet(t, base, "db", "port", 5432)
+	testGet(t, base, "db", "user", "app")
+	testGet(t, base, DEFAULT_SECTION, "env", "prod")
+	testGet(t, base, "cache", "size", 10)
+	if !base.HasSection("empty") {
+		t.Errorf("Merge failure: empty section not copied")
+	}
+
+	// New options follow the input order of the source.
+	var buf bytes.Buffer
+	base.WriteTo(&buf)
+	if i, j := strings.Index(buf.String(), "user"), strings.Index(buf.String(), "pool"); i > j {
+		t.Errorf("Merge failure: source order not kept:\n%s", buf.String())
+	}
+}
+
+func TestEnvPrefix(t *testing.T) {
+	os.Setenv("GO_CONFIG_TEST_DB_HOST", "env-host")
+	os.Setenv("GO_CONFIG_TEST_MY_APP_PORT", "9090")
+	os.Setenv("GO_CONFIG_TEST_LEVEL", "debug")
+	defer func() {
+		os.Unsetenv("GO_CONFIG_TEST_DB_HOST")
+		os.Unsetenv("GO_CONFIG_TEST_MY_APP_PORT")
+		os.Unsetenv("GO_CONFIG_TEST_LEVEL")
+	}()
+
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "level", "info")
+	c.AddOption("db", "host", "file-host")
+	c.AddOption("db", "user", "file-user")
+	c.AddOption("db", "url", "%(user)s@%(host)s")
+	c.AddOption("my app", "port", "8080")
+
+	// Without a prefix the file wins.
+	testGet(t, c, "db", "host", "file-host")
+
+	c.EnvPrefix = "go-config-test"
+	testGet(t, c, "db", "host", "env-host")
+	testGet(t, c, "db", "user", "file-user")
+	testGet(t, c, "db", "url", "file-user@env-host")
+	testGet(t, c, "my app", "port", 9090)
+	testGet(t, c, "db", "level", "debug")
+}
+
+func TestMarshalJSON(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("db", "port", "5432")
+	c.AddOption("db", "host", "%(server)s")
+	c.AddOption(DEFAULT_SECTION, "server", "localhost")
+	c.AddSection("empty")
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"DEFAULT":{"server":"localhost"},"db":{"host":"%(server)s","port":"5432"},"empty":{}}`
+	if string(b) != want {
+		t.Errorf("MarshalJSON failure: expected %s, got %s", want, b)
+	}
+}
+
+func TestInlineComments(t *testing.T) {
+	c := NewDefault()
+	err := c.read(bufio.NewReader(strings.NewReader(
+		"[s]\n" +
+			"port = 8080  # main listener\n" +
+			"color = \\#ff0000 ; red\n" +
+			"url = http://x/#frag\n" +
+			"semi = a;b\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, c, "s", "port", 8080)
+	testGet(t, c, "s", "color", "#ff0000")
+	testGet(t, c, "s", "url", "http://x/#frag")
+	testGet(t, c, "s", "semi", "a;b")
+
+	// Only "!" starts a comment.
+	c = NewDefault()
+	c.CommentChars = "!"
+	err = c.read(bufio.NewReader(strings.NewReader(
+		"! header\n[s]\nport = 8080 ! main listener\nnote = # not ; a comment\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, c, "s", "port", 8080)
+	testGet(t, c, "s", "note", "# not ; a comment")
+}
+
+func TestFloat32(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("s", "ok", "3.5")
+	c.AddOption("s", "big", "3.4028236e39")
+
+	if v, err := c.Float32("s", "ok"); err != nil || v != 3.5 {
+		t.Errorf("Float32 failure: expected 3.5, got %v (%v)", v, err)
+	}
+	if v, err := c.Float32("s", "big"); err == nil {
+		t.Errorf("Float32 failure: no error for overflow, got %v", v)
+	}
+	if _, err := c.Float("s", "big"); err != nil {
+		t.Errorf("Float failure: %s", err)
+	}
+
+	type Tconf struct {
+		Big32 float32 `config:"s:big"`
+	}
+	if err := c.ParseConf(new(Tconf)); err == nil {
+		t.Errorf("ParseConf failure: no error for float32 overflow")
+	}
+	type Tconf64 struct {
+		Big64 float64 `config:"s:big"`
+	}
+	if err := c.ParseConf(new(Tconf64)); err != nil {
+		t.Errorf("ParseConf failure: %s", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("db", "host", "shared")
+	c.RegisterBoolValues([]string{"enabled"}, nil)
+
+	clone := c.Clone()
+	testGet(t, clone, "db", "host", "shared")
+
+	clone.AddOption("db", "host", "request")
+	clone.AddOption("db", "user", "guest")
+	clone.AddSection("extra")
+	clone.RegisterBoolValues([]string{"sure"}, nil)
+
+	testGet(t, clone, "db", "host", "request")
+	testGet(t, c, "db", "host", "shared")
+	if c.HasOption("db", "user") || c.HasSection("extra") {
+		t.Errorf("Clone failure: changes to the clone leaked to the original")
+	}
+	if _, ok := c.boolValue("sure"); ok {
+		t.Errorf("Clone failure: bool values leaked to the original")
+	}
+	if _, ok := clone.boolValue("enabled"); !ok {
+		t.Errorf("Clone failure: bool values not copied")
+	}
+}
+
+func TestParseDottedTag(t *testing.T) {
+	type Tconf struct {
+		Host   string `config:"database.host"`
+		Port   int    `config:"app.db.port"`
+		Legacy string `config:"X:x.one"`
+	}
+	c := NewDefault()
+	c.AddOption("database", "host", "db1")
+	c.AddOption("app.db", "port", "5432")
+	c.AddOption("X", "x.one", "x1")
+
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Host != "db1" || conf.Port != 5432 || conf.Legacy != "x1" {
+		t.Errorf("ParseConf failure: dotted tags not loaded: %+v", conf)
+	}
+}
+
+func TestIntBase(t *testing.T) {
+	c := NewDefault()
+	for v, want := range map[string]int{
+		"0xFF":   255,
+		"0755":   493,
+		"0o755":  493,
+		"0b1010": 10,
+		"42":     42,
+		"-17":    -17,
+	} {
+		c.AddOption("s", "n", v)
+		if got, err := c.Int("s", "n"); err != nil || got != want {
+			t.Errorf("Int failure for %q: expected %d, got %d (%v)", v, want, got, err)
+		}
+		if got, err := c.Int64("s", "n"); err != nil || got != int64(want) {
+			t.Errorf("Int64 failure for %q: expected %d, got %d (%v)", v, want, got, err)
+		}
+	}
+
+	type Tconf struct {
+		Mask uint32 `config:"perm:mask"`
+		Mode int    `config:"perm:mode"`
+		Bits []int  `config:"perm:bits"`
+	}
+	c.AddOption("perm", "mask", "0xFF")
+	c.AddOption("perm", "mode", "0755")
+	c.AddOption("perm", "bits", "0b1, 0b10, 4")
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Mask != 255 || conf.Mode != 493 || !reflect.DeepEqual(conf.Bits, []int{1, 2, 4}) {
+		t.Errorf("ParseConf failure: based integers not loaded: %+v", conf)
+	}
+}
+
+type rangeConf struct {
+	Start int `config:"range:start"`
+	End   int `config:"range:end"`
+}
+
+func (r *rangeConf) Validate() error {
+	if r.Start >= r.End {
+		return errors.New("start must precede end")
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("range", "start", "1")
+	c.AddOption("range", "end", "5")
+	if err := c.ParseConf(new(rangeConf)); err != nil {
+		t.Fatalf("ParseConf failure: %v", err)
+	}
+
+	c.AddOption("range", "start", "9")
+	if err := c.ParseConf(new(rangeConf)); err == nil || err.Error() != "start must precede end" {
+		t.Errorf("ParseConf failure: expected the Validate error, got %v", err)
+	}
+
+	// Validate is not called when loading fails.
+	c.AddOption("range", "end", "x")
+	err := c.ParseConf(new(rangeConf))
+	var fe *FieldError
+	if !errors.As(err, &fe) {
+		t.Errorf("ParseConf failure: expected a FieldError, got %v", err)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	c := NewDefault()
+	for v, want := range map[string]int64{
+		"512":    512,
+		"10B":    10,
+		"10MB":   10e6,
+		"1.5 KB": 1500,
+		"512KiB": 512 << 10,
+		"2gib":   2 << 30,
+	} {
+		c.AddOption("s", "size", v)
+		if got, err := c.Bytes("s", "size"); err != nil || got != want {
+			t.Errorf("Bytes failure for %q: expected %d, got %d (%v)", v, want, got, err)
+		}
+	}
+	c.AddOption("s", "size", "10XB")
+	if _, err := c.Bytes("s", "size"); err == nil || !strings.Contains(err.Error(), `unknown byte size unit "XB"`) {
+		t.Errorf("Bytes failure: expected an unknown unit error, got %v", err)
+	}
+	for v, want := range map[string]string{
+		"-5MB":                 "negative",
+		"-1":                   "negative",
+		"9223372036854775808":  "out of range",
+		"9007199254740993TiB":  "out of range",
+		"9223372036854775807B": "",
+	} {
+		c.AddOption("s", "size", v)
+		got, err := c.Bytes("s", "size")
+		if want == "" {
+			if err != nil || got != math.MaxInt64 {
+				t.Errorf("Bytes failure for %q: expected %d, got %d (%v)", v, int64(math.MaxInt64), got, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Bytes failure for %q: expected a %s error, got %d (%v)", v, want, got, err)
+		}
+	}
+	// Integers above 2^53 keep their precision.
+	c.AddOption("s", "size", "9007199254740993")
+	if got, err := c.Bytes("s", "size"); err != nil || got != 9007199254740993 {
+		t.Errorf("Bytes failure: expected 9007199254740993, got %d (%v)", got, err)
+	}
+
+	type Tconf struct {
+		Upload int64  `config:"limits:upload" bytes:"true"`
+		Cache  uint32 `config:"limits:cache" bytes:"true" default:"64KiB"`
+	}
+	c.AddOption("limits", "upload", "10MB")
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Upload != 10e6 || conf.Cache != 64<<10 {
+		t.Errorf("ParseConf failure: byte sizes not loaded: %+v", conf)
+	}
+}
+
+func TestEnvVarDefault(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("db", "url", "${CONFIG_TEST_DB_URL:-localhost:5432}")
+	c.AddOption("db", "empty", "x${CONFIG_TEST_DB_URL:-}y")
+	c.AddOption("db", "plain", "${CONFIG_TEST_DB_URL}")
+
+	os.Unsetenv("CONFIG_TEST_DB_URL")
+	testGet(t, c, "db", "url", "localhost:5432")
+	testGet(t, c, "db", "empty", "xy")
+	if _, err := c.String("db", "plain"); err == nil {
+		t.Errorf("String failure: expected an error for an unset variable without default")
+	}
+
+	t.Setenv("CONFIG_TEST_DB_URL", "db.example.com:5432")
+	testGet(t, c, "db", "url", "db.example.com:5432")
+	testGet(t, c, "db", "plain", "db.example.com:5432")
+}
+
+func TestSectionsMatching(t *testing.T) {
+	c := NewDefault()
+	c.AddSection("plugin:zip")
+	c.AddSection("server")
+	c.AddSection("plugin:auth")
+	c.AddSection("myplugin:x")
+
+	got, err := c.SectionsMatching("^plugin:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"plugin:auth", "plugin:zip"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SectionsMatching failure: expected %v, got %v", want, got)
+	}
+
+	if got, err = c.SectionsMatching("^none"); err != nil || len(got) != 0 {
+		t.Errorf("SectionsMatching failure: expected no sections, got %v (%v)", got, err)
+	}
+	if _, err = c.SectionsMatching("plugin:("); err == nil {
+		t.Errorf("SectionsMatching failure: expected an error for an invalid pattern")
+	}
+}
+
+func TestUnfoldEmptyOverride(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "suffix", "-default")
+	c.AddOption("override", "suffix", "")
+	c.AddOption("override", "name", "app%(suffix)s")
+	c.AddOption("absent", "name", "app%(suffix)s")
+
+	testGet(t, c, "override", "name", "app")
+	testGet(t, c, "absent", "name", "app-default")
+
+	c.AddOption("missing", "name", "app%(nothing)s")
+	if _, err := c.String("missing", "name"); err == nil {
+		t.Errorf("String failure: expected an error for a missing variable")
+	}
+}
+
+func TestArrayField(t *testing.T) {
+	type Tconf struct {
+		Coords [3]float64 `config:"shape:coords"`
+		RGB    [3]uint8   `config:"shape:rgb" sep:" "`
+	}
+	c := NewDefault()
+	c.AddOption("shape", "coords", "1.5, -2, 3")
+	c.AddOption("shape", "rgb", "255 128 0")
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Coords != [3]float64{1.5, -2, 3} || conf.RGB != [3]uint8{255, 128, 0} {
+		t.Errorf("ParseConf failure: arrays not loaded: %+v", conf)
+	}
+
+	for _, v := range []string{"1, 2", "1, 2, 3, 4"} {
+		c.AddOption("shape", "coords", v)
+		err := c.ParseConf(new(Tconf))
+		var fe *FieldError
+		if !errors.As(err, &fe) || fe.Option != "coords" || !strings.Contains(err.Error(), "expected 3 elements") {
+			t.Errorf("ParseConf failure for %q: expected a length error, got %v", v, err)
+		}
+	}
+}
+
+func TestParseConfStrict(t *testing.T) {
+	type Server struct {
+		Port int `config:":port"`
+	}
+	type Tconf struct {
+		Host    string            `config:"db:host"`
+		Labels  map[string]string `config:"labels"`
+		Servers []Server          `config:"server:*:"`
+	}
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "base", "/srv")
+	c.AddOption("db", "host", "localhost")
+	c.AddOption("labels", "env", "prod")
+	c.AddOption("server:a", "port", "80")
+	if err := c.ParseConfStrict(new(Tconf)); err != nil {
+		t.Fatalf("ParseConfStrict failure: %v", err)
+	}
+
+	c.AddOption("db", "unused", "x")
+	c.AddOption("server:a", "prot", "81")
+	if err := c.ParseConf(new(Tconf)); err != nil {
+		t.Errorf("ParseConf failure: %v", err)
+	}
+	err := c.ParseConfStrict(new(Tconf))
+	if err == nil || err.Error() != "unknown options: [db] unused, [server:a] prot" {
+		t.Errorf("ParseConfStrict failure: expected the unused options, got %v", err)
+	}
+}
+
+type logLevel int
+
+func (l *logLevel) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "debug":
+		*l = 0
+	case "info":
+		*l = 1
+	default:
+		return errors.New("unknown log level " + string(text))
+	}
+	return nil
+}
+
+func TestTextUnmarshaler(t *testing.T) {
+	type Tconf struct {
+		Level    logLevel  `config:"log:level"`
+		Fallback *logLevel `config:"log:fallback" default:"debug"`
+		Missing  *logLevel `config:"log:missing"`
+	}
+	c := NewDefault()
+	c.AddOption("log", "level", "info")
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Level != 1 || conf.Fallback == nil || *conf.Fallback != 0 || conf.Missing != nil {
+		t.Errorf("ParseConf failure: log levels not loaded: %+v", conf)
+	}
+
+	c.AddOption("log", "level", "loud")
+	err := c.ParseConf(new(Tconf))
+	var fe *FieldError
+	if !errors.As(err, &fe) || fe.Option != "level" || !strings.Contains(err.Error(), "unknown log level loud") {
+		t.Errorf("ParseConf failure: expected the UnmarshalText error, got %v", err)
+	}
+
+	// Elements parse themselves too.
+	type Tlist struct {
+		Levels []logLevel          `config:"log:levels"`
+		Arr    [2]logLevel         `config:"log:levels"`
+		ByName map[string]logLevel `config:"log:byname"`
+	}
+	c.AddOption("log", "levels", "info, debug")
+	c.AddOption("log", "byname", "a=debug, b=info")
+	list := new(Tlist)
+	if err = c.ParseConf(list); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list.Levels, []logLevel{1, 0}) || list.Arr != [2]logLevel{1, 0} ||
+		!reflect.DeepEqual(list.ByName, map[string]logLevel{"a": 0, "b": 1}) {
+		t.Errorf("ParseConf failure: expected the log level elements, got %+v", list)
+	}
+	c.AddOption("log", "levels", "info, loud")
+	if err = c.ParseConf(list); err == nil || !strings.Contains(err.Error(), "unknown log level loud") {
+		t.Errorf("ParseConf failure: expected the UnmarshalText error, got %v", err)
+	}
+}
+
+func TestGetSectionAsMap(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "root", "/srv")
+	c.AddOption(DEFAULT_SECTION, "user", "nobody")
+	c.AddOption("plugin", "user", "www")
+	c.AddOption("plugin", "dir", "%(root)s/plugin")
+
+	m, err := c.GetSectionAsMap("plugin", false, false)
+	if want := map[string]string{"user": "www", "dir": "%(root)s/plugin"}; err != nil || !reflect.DeepEqual(m, want) {
+		t.Errorf("GetSectionAsMap failure: expected %v, got %v (%v)", want, m, err)
+	}
+	m, err = c.GetSectionAsMap("plugin", true, true)
+	if want := map[string]string{"root": "/srv", "user": "www", "dir": "/srv/plugin"}; err != nil || !reflect.DeepEqual(m, want) {
+		t.Errorf("GetSectionAsMap failure: expected %v, got %v (%v)", want, m, err)
+	}
+
+	_, err = c.GetSectionAsMap("none", true, false)
+	if _, ok := err.(SectionError); !ok {
+		t.Errorf("GetSectionAsMap failure: expected a SectionError, got %v", err)
+	}
+}
+
+func TestContinuationLines(t *testing.T) {
+	c := NewDefault()
+	err := c.read(bufio.NewReader(strings.NewReader(
+		"[db]\n" +
+			"query = SELECT id, name \\\n" +
+			"        FROM users \\\n" +
+			"        WHERE id = 1\n" +
+			"hosts = a\n" +
+			"  b\n" +
+			"\tc\n" +
+			"last = end\\\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, c, "db", "query", "SELECT id, name FROM users WHERE id = 1")
+	testGet(t, c, "db", "hosts", "a\nb\nc")
+	testGet(t, c, "db", "last", "end")
+}
+
+func TestBytesField(t *testing.T) {
+	type Tconf struct {
+		Secret []byte `config:"auth:secret"`
+		Token  []byte `config:"auth:token" default:"a,b"`
+	}
+	c := NewDefault()
+	c.AddOption("auth", "secret", "s3cr3t, with comma")
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if string(conf.Secret) != "s3cr3t, with comma" || string(conf.Token) != "a,b" {
+		t.Errorf("ParseConf failure: []byte fields not loaded as strings: %q, %q", conf.Secret, conf.Token)
+	}
+}
+
+func TestNewFromString(t *testing.T) {
+	c, err := NewFromString(`
+host = example.com
+
+[web]
+url = http://%(host)s/
+port = 8080
+
+[db]
+name = app
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, c, "web", "url", "http://example.com/")
+	testGet(t, c, "web", "port", 8080)
+	testGet(t, c, "db", "name", "app")
+
+	if _, err = NewFromString("[db]\nnot an option\n"); err == nil {
+		t.Errorf("NewFromString failure: expected a parse error")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "host", "example.com")
+	c.AddOption("db", "url", "pg://%(host)s")
+	c.AddOption("app.v2", "name", "new")
+
+	for path, want := range map[string]string{
+		"db.url":      "pg://example.com",
+		"host":        "example.com",
+		"db.host":     "example.com",
+		"app.v2.name": "new",
+	} {
+		if got, err := c.Lookup(path); err != nil || got != want {
+			t.Errorf("Lookup failure for %q: expected %q, got %q (%v)", path, want, got, err)
+		}
+	}
+	for _, path := range []string{"db.none", "none", "none.url"} {
+		if _, err := c.Lookup(path); err == nil {
+			t.Errorf("Lookup failure for %q: expected an error", path)
+		}
+	}
+}
+
+func TestGetenv(t *testing.T) {
+	env := map[string]string{"CONFIG_FAKE_HOST": "fake.example.com", "APP_DB_PORT": "6543"}
+	c := NewDefault()
+	c.Getenv = func(name string) string { return env[name] }
+	c.EnvPrefix = "APP"
+	c.AddOption("db", "host", "${CONFIG_FAKE_HOST}")
+	c.AddOption("db", "port", "5432")
+	c.AddOption("db", "user", "${CONFIG_FAKE_USER:-nobody}")
+
+	testGet(t, c, "db", "host", "fake.example.com")
+	testGet(t, c, "db", "port", 6543)
+	testGet(t, c, "db", "user", "nobody")
+	if _, ok := os.LookupEnv("CONFIG_FAKE_HOST"); ok {
+		t.Errorf("Getenv failure: the process environment was changed")
+	}
+}
+
+func TestComplex(t *testing.T) {
+	c := NewDefault()
+	for v, want := range map[string]complex128{
+		"1.5":      1.5,
+		"2.3i":     2.3i,
+		"1.5+2.3i": 1.5 + 2.3i,
+		"(1-2i)":   1 - 2i,
+	} {
+		c.AddOption("dsp", "gain", v)
+		if got, err := c.Complex128("dsp", "gain"); err != nil || got != want {
+			t.Errorf("Complex128 failure for %q: expected %v, got %v (%v)", v, want, got, err)
+		}
+	}
+	c.AddOption("dsp", "gain", "1+i2")
+	if _, err := c.Complex128("dsp", "gain"); err == nil || !strings.Contains(err.Error(), "could not parse complex value") {
+		t.Errorf("Complex128 failure: expected a parse error, got %v", err)
+	}
+
+	type Tconf struct {
+		Gain  complex128  `config:"filter:gain"`
+		Coefs []complex64 `config:"filter:coefs"`
+		Pole  *complex128 `config:"filter:pole"`
+	}
+	c.AddOption("filter", "gain", "0.5-1i")
+	c.AddOption("filter", "coefs", "1, 2i, 3+4i")
+	c.AddOption("filter", "pole", "-1i")
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Gain != 0.5-1i || !reflect.DeepEqual(conf.Coefs, []complex64{1, 2i, 3 + 4i}) || *conf.Pole != -1i {
+		t.Errorf("ParseConf failure: complex fields not loaded: %+v", conf)
+	}
+}
+
+func TestQuotedValues(t *testing.T) {
+	c, err := NewFromString(`[fmt]
+indent = "  indented  "
+escaped = "a\tb\nc \"q\" \\ d"
+plain =   trimmed   
+partial = "open
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, c, "fmt", "indent", "  indented  ")
+	testGet(t, c, "fmt", "escaped", "a\tb\nc \"q\" \\ d")
+	testGet(t, c, "fmt", "plain", "trimmed")
+	testGet(t, c, "fmt", "partial", `"open`)
+
+	// Quoting is kept when writing, so the values read back the same.
+	c.AddOption("fmt", "quoted", `"q"`)
+	var buf bytes.Buffer
+	if _, err = c.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	cr, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range []string{"indent", "escaped", "plain", "quoted"} {
+		want, _ := c.RawString("fmt", option)
+		testGet(t, cr, "fmt", option, want)
+	}
+}
+
+func TestOptionsBeforeHeader(t *testing.T) {
+	c, err := NewFromString(`root = /srv
+hosts = a
+	b
+
+[app]
+dir = %(root)s/app
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for option, want := range map[string]string{"root": "/srv", "hosts": "a\nb"} {
+		if got, err := c.RawStringDefault(option); err != nil || got != want {
+			t.Errorf("RawStringDefault failure for %q: expected %q, got %q (%v)", option, want, got, err)
+		}
+	}
+	testGet(t, c, "app", "dir", "/srv/app")
+	testGet(t, c, "app", "root", "/srv")
+}
+
+func TestSectionError(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "base", "/srv")
+	c.AddOption("db", "host", "localhost")
+
+	var se SectionError
+	var oe OptionError
+	_, err := c.String("none", "host")
+	if !errors.As(err, &se) || string(se) != "none" {
+		t.Errorf("String failure: expected a SectionError, got %v", err)
+	}
+	_, err = c.String("db", "port")
+	if !errors.As(err, &oe) || string(oe) != "port" {
+		t.Errorf("String failure: expected an OptionError, got %v", err)
+	}
+	// The default section is still searched when the section does not exist.
+	testGet(t, c, "none", "base", "/srv")
+
+	if _, err = c.Options("none"); !errors.As(err, &se) {
+		t.Errorf("Options failure: expected a SectionError, got %v", err)
+	}
+	if v, err := c.IntDefault("none", "port", 5432); err != nil || v != 5432 {
+		t.Errorf("IntDefault failure: expected the default, got %d (%v)", v, err)
+	}
+}
+
+func TestParseConfSection(t *testing.T) {
+	for name, want := range map[string]string{
+		"Host":        "host",
+		"MaxConns":    "max_conns",
+		"HTTPPort":    "http_port",
+		"DBHost":      "db_host",
+		"Retry2Count": "retry2_count",
+		"ID":          "id",
+	} {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase failure for %q: expected %q, got %q", name, want, got)
+		}
+	}
+
+	type Tconf struct {
+		Host     string
+		MaxConns int
+		HTTPPort int
+		Timeout  time.Duration `config:":timeout_ms"`
+		Skipped  string        `config:"-"`
+		Other    string        `config:"other:name"`
+		internal string
+	}
+	c := NewDefault()
+	c.AddOption("db", "host", "localhost")
+	c.AddOption("db", "max_conns", "10")
+	c.AddOption("db", "http_port", "8080")
+	c.AddOption("db", "timeout_ms", "5s")
+	c.AddOption("db", "skipped", "x")
+	c.AddOption("db", "internal", "x")
+	c.AddOption("other", "name", "o")
+
+	conf := new(Tconf)
+	if err := c.ParseConfSection(conf, "db"); err != nil {
+		t.Fatal(err)
+	}
+	want := Tconf{Host: "localhost", MaxConns: 10, HTTPPort: 8080, Timeout: 5 * time.Second, Other: "o"}
+	if *conf != want {
+		t.Errorf("ParseConfSection failure: expected %+v, got %+v", want, *conf)
+	}
+
+	// Without a section, untagged fields are still skipped.
+	plain := &struct {
+		Host  string
+		Other string `config:"other:name"`
+	}{}
+	if err := c.ParseConf(plain); err != nil || plain.Host != "" || plain.Other != "o" {
+		t.Errorf("ParseConf failure: untagged fields loaded: %+v (%v)", plain, err)
+	}
+}
+
+func TestDumpString(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("db", "host", "localhost")
+	c.AddOption("db", "DB_Password", "hunter2")
+	c.AddOption("api", "secret", "s3cr3t")
+
+	if s := c.DumpString(); !strings.Contains(s, "hunter2") || !strings.Contains(s, "[db]") {
+		t.Errorf("DumpString failure: unmasked dump expected, got %q", s)
+	}
+	s := c.DumpString("*password*", "*secret*")
+	if strings.Contains(s, "hunter2") || strings.Contains(s, "s3cr3t") {
+		t.Errorf("DumpString failure: sensitive values not masked: %q", s)
+	}
+	if !strings.Contains(s, "DB_Password: ****") || !strings.Contains(s, "secret: ****") || !strings.Contains(s, "host: localhost") {
+		t.Errorf("DumpString failure: unexpected masked dump %q", s)
+	}
+	testGet(t, c, "db", "DB_Password", "hunter2")
+}
+
+func TestDumpStringRepeated(t *testing.T) {
+	c := NewDefault()
+	c.AccumulateRepeated = true
+	if err := c.read(bufio.NewReader(strings.NewReader("[db]\npassword = a1\npassword = b2\n"))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := c.DumpString("password")
+	if strings.Contains(s, "a1") || strings.Contains(s, "b2") || strings.Count(s, "password: ****") != 2 {
+		t.Errorf("DumpString failure: repeated values not masked: %q", s)
+	}
+	if vs, err := c.Values("db", "password"); err != nil || !reflect.DeepEqual(vs, []string{"a1", "b2"}) {
+		t.Errorf("Values failure: original changed to %q, %v", vs, err)
+	}
+
+	// Merging keeps the repeated values.
+	merged := NewDefault()
+	merged.Merge(c)
+	if vs, err := merged.Values("db", "password"); err != nil || !reflect.DeepEqual(vs, []string{"a1", "b2"}) {
+		t.Errorf("Merge failure: repeated values %q, %v", vs, err)
+	}
+}
+
+func TestAccumulateRepeated(t *testing.T) {
+	const data = `[main]
+include = a.conf
+include = b.conf,
+	c.conf
+name = x
+include = d.conf
+`
+	c := NewDefault()
+	c.AccumulateRepeated = true
+	if err := c.read(bufio.NewReader(strings.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.conf", "b.conf,\nc.conf", "d.conf"}
+	if got, err := c.Values("main", "include"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Values failure: expected %q, got %q (%v)", want, got, err)
+	}
+	testGet(t, c, "main", "include", "d.conf")
+	if got, err := c.Values("main", "name"); err != nil || !reflect.DeepEqual(got, []string{"x"}) {
+		t.Errorf("Values failure: expected a single value, got %q (%v)", got, err)
+	}
+
+	type Tconf struct {
+		Include []string `config:"main:include"`
+		Name    []string `config:"main:name"`
+	}
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.Include, want) || !reflect.DeepEqual(conf.Name, []string{"x"}) {
+		t.Errorf("ParseConf failure: repeated values not loaded: %+v", conf)
+	}
+
+	// The repeated values are written back one per line.
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	cr := NewDefault()
+	cr.AccumulateRepeated = true
+	if err := cr.read(bufio.NewReader(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cr.Values("main", "include"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("WriteTo failure: expected %q, got %q (%v)", want, got, err)
+	}
+
+	// Without AccumulateRepeated the last value wins.
+	c = NewDefault()
+	if err := c.read(bufio.NewReader(strings.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Values("main", "include"); err != nil || !reflect.DeepEqual(got, []string{"d.conf"}) {
+		t.Errorf("Values failure: expected the last value, got %q (%v)", got, err)
+	}
+}
+
+func TestOptionsWithPrefix(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "feature_default", "on")
+	c.AddOption("flags", "feature_search", "on")
+	c.AddOption("flags", "feature_chat", "off")
+	c.AddOption("flags", "feature_beta", "%(feature_search)s")
+	c.AddOption("flags", "features", "all")
+	c.AddOption("flags", "other", "x")
+
+	m, err := c.OptionsWithPrefix("flags", "feature_", false)
+	want := map[string]string{"feature_search": "on", "feature_chat": "off", "feature_beta": "on"}
+	if err != nil || !reflect.DeepEqual(m, want) {
+		t.Errorf("OptionsWithPrefix failure: expected %v, got %v (%v)", want, m, err)
+	}
+	m, err = c.OptionsWithPrefix("flags", "feature_", true)
+	want = map[string]string{"search": "on", "chat": "off", "beta": "on"}
+	if err != nil || !reflect.DeepEqual(m, want) {
+		t.Errorf("OptionsWithPrefix failure: expected %v, got %v (%v)", want, m, err)
+	}
+	if _, err = c.OptionsWithPrefix("none", "feature_", true); err == nil {
+		t.Errorf("OptionsWithPrefix failure: expected an error for a missing section")
+	}
+}
+
+func TestRegisteredBoolFields(t *testing.T) {
+	type Tconf struct {
+		Flags []bool `config:"main:flags"`
+		One   bool   `config:"main:one"`
+	}
+	c := NewDefault()
+	c.RegisterBoolValues([]string{"yes2"}, []string{"no2"})
+	c.AddOption("main", "flags", "yes2, no2, true, YES2")
+	c.AddOption("main", "one", "no2")
+	conf := &Tconf{One: true}
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.Flags, []bool{true, false, true, true}) || conf.One {
+		t.Errorf("ParseConf failure: registered bools not loaded: %+v", conf)
+	}
+	if v, err := c.Bool("main", "one"); err != nil || v {
+		t.Errorf("Bool failure: expected false, got %v (%v)", v, err)
+	}
+
+	// Other configurations do not accept them.
+	o := NewDefault()
+	o.AddOption("main", "flags", "yes2")
+	if err := o.ParseConf(new(Tconf)); err == nil {
+		t.Errorf("ParseConf failure: bool registered on another Config accepted")
+	}
+}
+
+type defaultsConf struct {
+	Host    string        `config:"db:host"`
+	Port    int           `config:"db:port"`
+	Timeout time.Duration `config:"db:timeout" default:"5s"`
+}
+
+func (d *defaultsConf) Defaults() {
+	d.Host = "localhost"
+	d.Port = 5432
+	d.Timeout = time.Minute
+}
+
+func TestDefaulter(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("db", "port", "6543")
+	conf := new(defaultsConf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	// The default tag still applies after Defaults, as a missing option does.
+	want := defaultsConf{Host: "localhost", Port: 6543, Timeout: 5 * time.Second}
+	if *conf != want {
+		t.Errorf("ParseConf failure: expected %+v, got %+v", want, *conf)
+	}
+}
+
+type EmbeddedDefaults struct {
+	Level string   `config:"log:level"`
+	Tags  []string `config:"log:tags"`
+}
+
+func (d *EmbeddedDefaults) Defaults() {
+	d.Level = "info"
+	d.Tags = append(d.Tags, "x")
+}
+
+type outerDefaults struct {
+	EmbeddedDefaults
+}
+
+func (d *outerDefaults) Defaults() {
+	d.EmbeddedDefaults.Defaults()
+	d.Level = "debug"
+}
+
+type promotedDefaults struct {
+	EmbeddedDefaults
+}
+
+type OtherDefaults struct{ Size int }
+
+func (d *OtherDefaults) Defaults() { d.Size = 10 }
+
+// ambiguousDefaults has no Defaults, since both embedded structs have one.
+type ambiguousDefaults struct {
+	EmbeddedDefaults
+	OtherDefaults
+}
+
+func TestDefaulterEmbedded(t *testing.T) {
+	c := NewDefault()
+
+	outer := new(outerDefaults)
+	if err := c.ParseConf(outer); err != nil {
+		t.Fatal(err)
+	}
+	if outer.Level != "debug" || !reflect.DeepEqual(outer.Tags, []string{"x"}) {
+		t.Errorf("ParseConf failure: outer Defaults overridden: %+v", outer)
+	}
+
+	promoted := new(promotedDefaults)
+	if err := c.ParseConf(promoted); err != nil {
+		t.Fatal(err)
+	}
+	if promoted.Level != "info" || !reflect.DeepEqual(promoted.Tags, []string{"x"}) {
+		t.Errorf("ParseConf failure: promoted Defaults not called once: %+v", promoted)
+	}
+
+	ambiguous := new(ambiguousDefaults)
+	if err := c.ParseConf(ambiguous); err != nil {
+		t.Fatal(err)
+	}
+	if ambiguous.Level != "info" || ambiguous.Size != 10 {
+		t.Errorf("ParseConf failure: embedded Defaults not called: %+v", ambiguous)
+	}
+}
+
+func TestPercent(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("limits", "cpu", "75%")
+	c.AddOption("limits", "mem", "0.5")
+	c.AddOption("limits", "burst", "150 %")
+	c.AddOption("limits", "bad", "lots%")
+
+	for _, tt := range []struct {
+		option  string
+		hundred bool
+		want    float64
+	}{
+		{"cpu", false, 0.75},
+		{"cpu", true, 75},
+		{"mem", false, 0.5},
+		{"mem", true, 50},
+		{"burst", false, 1.5},
+	} {
+		if got, err := c.Percent("limits", tt.option, tt.hundred, false); err != nil || got != tt.want {
+			t.Errorf("Percent failure for %s: expected %v, got %v (%v)", tt.option, tt.want, got, err)
+		}
+	}
+	if _, err := c.Percent("limits", "burst", false, true); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("Percent failure: expected a range error, got %v", err)
+	}
+	if v, err := c.Percent("limits", "cpu", true, true); err != nil || v != 75 {
+		t.Errorf("Percent failure: expected 75 in strict mode, got %v (%v)", v, err)
+	}
+	if _, err := c.Percent("limits", "bad", false, false); err == nil {
+		t.Errorf("Percent failure: expected a parse error")
+	}
+}
+
+type commonConf struct {
+	LogLevel string `config:"common:log_level"`
+	Debug    bool   `config:"common:debug"`
+}
+
+type namedInt int
+
+func TestEmbeddedStruct(t *testing.T) {
+	type Tconf struct {
+		commonConf
+		namedInt
+		Host string `config:"db:host"`
+	}
+	c := NewDefault()
+	c.AddOption("common", "log_level", "info")
+	c.AddOption("common", "debug", "true")
+	c.AddOption("db", "host", "localhost")
+
+	conf := new(Tconf)
+	if err := c.ParseConfStrict(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.LogLevel != "info" || !conf.Debug || conf.Host != "localhost" || conf.namedInt != 0 {
+		t.Errorf("ParseConf failure: embedded struct not loaded: %+v", conf)
+	}
+
+	c.AddOption("common", "debug", "maybe")
+	err := c.ParseConf(new(Tconf))
+	var fe *FieldError
+	if !errors.As(err, &fe) || fe.Option != "debug" {
+		t.Errorf("ParseConf failure: expected a FieldError from the embedded struct, got %v", err)
+	}
+}
+
+func TestReplaceData(t *testing.T) {
+	live := NewDefault()
+	live.AddOption("db", "host", "old")
+	live.AddOption("db", "port", "1")
+	live.AddOption("legacy", "x", "y")
+
+	fresh := NewDefault()
+	fresh.AddOption("db", "host", "new")
+	fresh.AddOption("db", "port", "2")
+
+	// Run with -race: readers must see the host and port of the same data.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				live.mu.RLock()
+				host, _ := live.rawString("db", "host")
+				port, _ := live.rawString("db", "port")
+				live.mu.RUnlock()
+				if host == "old" && port != "1" || host == "new" && port != "2" {
+					t.Errorf("ReplaceData failure: torn read %q %q", host, port)
+					return
+				}
+			}
+		}()
+	}
+	live.ReplaceData(fresh)
+	wg.Wait()
+
+	testGet(t, live, "db", "host", "new")
+	if live.HasSection("legacy") {
+		t.Errorf("ReplaceData failure: old section kept")
+	}
+	if !reflect.DeepEqual(live.Sections(), fresh.Sections()) {
+		t.Errorf("ReplaceData failure: sections %v, expected %v", live.Sections(), fresh.Sections())
+	}
+	// The data is copied, not shared.
+	fresh.AddOption("db", "host", "later")
+	testGet(t, live, "db", "host", "new")
+}
+
+func TestIP(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "net", "10.0.0.0")
+	c.AddOption("server", "bind", "0.0.0.0")
+	c.AddOption("server", "bind6", "::1")
+	c.AddOption("server", "allowed", "%(net)s/8")
+	c.AddOption("server", "bad", "300.1.2.3")
+
+	if ip, err := c.IP("server", "bind"); err != nil || !ip.Equal(net.IPv4zero) {
+		t.Errorf("IP failure: got %v (%v)", ip, err)
+	}
+	if ip, err := c.IP("server", "bind6"); err != nil || !ip.Equal(net.IPv6loopback) {
+		t.Errorf("IP failure: got %v (%v)", ip, err)
+	}
+	if n, err := c.IPNet("server", "allowed"); err != nil || n.String() != "10.0.0.0/8" {
+		t.Errorf("IPNet failure: got %v (%v)", n, err)
+	}
+	if _, err := c.IP("server", "bad"); err == nil || !strings.Contains(err.Error(), "[server] bad") {
+		t.Errorf("IP failure: expected an error naming the option, got %v", err)
+	}
+	if _, err := c.IPNet("server", "bind"); err == nil || !strings.Contains(err.Error(), "[server] bind") {
+		t.Errorf("IPNet failure: expected an error naming the option, got %v", err)
+	}
+
+	type Tconf struct {
+		Bind    net.IP     `config:"server:bind"`
+		Allowed *net.IPNet `config:"server:allowed"`
+		Local   net.IPNet  `config:"server:local" default:"127.0.0.0/8"`
+	}
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if !conf.Bind.Equal(net.IPv4zero) || conf.Allowed.String() != "10.0.0.0/8" || conf.Local.String() != "127.0.0.0/8" {
+		t.Errorf("ParseConf failure: addresses not loaded: %+v", conf)
+	}
+
+	c.AddOption("server", "allowed", "10.0.0.0")
+	err := c.ParseConf(new(Tconf))
+	var fe *FieldError
+	if !errors.As(err, &fe) || fe.Option != "allowed" {
+		t.Errorf("ParseConf failure: expected a FieldError, got %v", err)
+	}
+}
+
+func TestURL(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "host", "example.com")
+	c.AddOption("api", "endpoint", "https://%(host)s/v1")
+	c.AddOption("api", "path", "/v1/users")
+	c.AddOption("api", "bad", "http://[::1")
+
+	u, err := c.URL("api", "endpoint", "https")
+	if err != nil || u.Host != "example.com" || u.Path != "/v1" {
+		t.Errorf("URL failure: got %v (%v)", u, err)
+	}
+	if u, err = c.URL("api", "path", ""); err != nil || u.IsAbs() || u.Path != "/v1/users" {
+		t.Errorf("URL failure: relative URL not accepted: %v (%v)", u, err)
+	}
+	if _, err = c.URL("api", "path", "https"); err == nil {
+		t.Errorf("URL failure: relative URL accepted with a required scheme")
+	}
+	if _, err = c.URL("api", "bad", ""); err == nil {
+		t.Errorf("URL failure: malformed URL accepted")
+	}
+
+	type Tconf struct {
+		Endpoint *url.URL `config:"api:endpoint" scheme:"https"`
+		Path     url.URL  `config:"api:path"`
+	}
+	conf := new(Tconf)
+	if err = c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Endpoint.String() != "https://example.com/v1" || conf.Path.String() != "/v1/users" {
+		t.Errorf("ParseConf failure: URLs not loaded: %+v", conf)
+	}
+
+	c.AddOption("api", "endpoint", "http://example.com/")
+	var fe *FieldError
+	if err = c.ParseConf(new(Tconf)); !errors.As(err, &fe) || fe.Option != "endpoint" {
+		t.Errorf("ParseConf failure: expected a scheme error, got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := NewDefault()
+	a.AddOption(DEFAULT_SECTION, "env", "dev")
+	a.AddOption("db", "host", "localhost")
+	a.AddOption("db", "port", "5432")
+	a.AddOption("legacy", "x", "1")
+	a.AddOption("legacy", "y", "2")
+
+	b := a.Clone()
+	b.AddOption("db", "port", "6543")
+	b.AddOption("db", "user", "app")
+	b.AddOption("cache", "size", "10MB")
+	b.RemoveSection("legacy")
+
+	added, removed, changed := Diff(a, b)
+	if want := []string{"cache.size", "db.user"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("Diff failure: added %v, expected %v", added, want)
+	}
+	if want := []string{"legacy.x", "legacy.y"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("Diff failure: removed %v, expected %v", removed, want)
+	}
+	if want := []string{"db.port"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("Diff failure: changed %v, expected %v", changed, want)
+	}
+
+	if added, removed, changed = Diff(a, a.Clone()); added != nil || removed != nil || changed != nil {
+		t.Errorf("Diff failure: differences in a copy: %v %v %v", added, removed, changed)
+	}
+}
+
+func TestSignedIntSlice(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("s", "offsets", "-1, +2, 3 ,-0x10")
+
+	want := []int{-1, 2, 3, -16}
+	if got, err := c.IntSlice("s", "offsets", ""); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("IntSlice failure: expected %v, got %v (%v)", want, got, err)
+	}
+
+	type Tconf struct {
+		Offsets []int   `config:"s:offsets"`
+		Small   []int8  `config:"s:offsets"`
+		Wide    []int64 `config:"s:offsets"`
+	}
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.Offsets, want) || !reflect.DeepEqual(conf.Small, []int8{-1, 2, 3, -16}) ||
+		!reflect.DeepEqual(conf.Wide, []int64{-1, 2, 3, -16}) {
+		t.Errorf("ParseConf failure: signed elements not loaded: %+v", conf)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	defer func(d time.Duration) { watchInterval = d }(watchInterval)
+	watchInterval = 10 * time.Millisecond
+
+	fname := t.TempDir() + "/watch.cfg"
+	if err := os.WriteFile(fname, []byte("[db]\nhost = old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadDefault(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloads := make(chan error, 10)
+	stop, err := c.WatchFile(fname, func(err error) { reloads <- err })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	// Write the new contents aside and rename them into place, so the
+	// watcher never sees a half-written file, and move the modification
+	// time on, in case the file system is coarse. Reloads still pending are
+	// drained first, so wait sees the one for this change.
+	change := func(data string, mod time.Time) {
+		for len(reloads) > 0 {
+			<-reloads
+		}
+		tmp := fname + ".tmp"
+		if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(tmp, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, fname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wait := func() error {
+		select {
+		case err := <-reloads:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("WatchFile failure: no reload")
+		}
+		return nil
+	}
+
+	change("[db]\nhost = new\nport = 1\n", time.Now().Add(time.Minute))
+	if err = wait(); err != nil {
+		t.Fatalf("WatchFile failure: %v", err)
+	}
+	testGet(t, c, "db", "host", "new")
+	testGet(t, c, "db", "port", 1)
+
+	change("[db\n", time.Now().Add(2*time.Minute))
+	if err = wait(); err == nil {
+		t.Errorf("WatchFile failure: no error for a malformed file")
+	}
+	testGet(t, c, "db", "host", "new")
+
+	stop()
+	stop()
+	if _, err = c.WatchFile(fname+".none", nil); err == nil {
+		t.Errorf("WatchFile failure: no error for a missing file")
+	}
+}
+
+func TestRawField(t *testing.T) {
+	type Tconf struct {
+		Template string   `config:"mail-template" raw:"true"`
+		Subject  string   `config:"mail-subject"`
+		Lines    []string `config:"mail-lines" raw:"true" sep:";"`
+	}
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "name", "world")
+	c.AddOption("mail", "template", "Hello %(name)s, ${USER}")
+	c.AddOption("mail", "subject", "Hi %(name)s")
+	c.AddOption("mail", "lines", "%(name)s; %(missing)s")
+
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Template != "Hello %(name)s, ${USER}" || conf.Subject != "Hi world" ||
+		!reflect.DeepEqual(conf.Lines, []string{"%(name)s", "%(missing)s"}) {
+		t.Errorf("ParseConf failure: raw fields unfolded: %+v", conf)
+	}
+}
+
+func TestIntFieldRange(t *testing.T) {
+	type Tconf struct {
+		I8  int8   `config:"n:i8"`
+		I16 int16  `config:"n:i16"`
+		U8  uint8  `config:"n:u8"`
+		U16 uint16 `config:"n:u16"`
+	}
+	c := NewDefault()
+	c.AddOption("n", "i8", "-128")
+	c.AddOption("n", "i16", "32767")
+	c.AddOption("n", "u8", "0xff")
+	c.AddOption("n", "u16", "65535")
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if *conf != (Tconf{-128, 32767, 255, 65535}) {
+		t.Errorf("ParseConf failure: limits not loaded: %+v", conf)
+	}
+
+	for option, v := range map[string]string{"i8": "300", "i16": "-40000", "u8": "256", "u16": "-1"} {
+		o := NewDefault()
+		o.AddOption("n", option, v)
+		err := o.ParseConf(new(Tconf))
+		var ne *strconv.NumError
+		if !errors.As(err, &ne) || !strings.Contains(err.Error(), "[n] "+option) {
+			t.Errorf("ParseConf failure for %s = %s: expected a range error, got %v", option, v, err)
+		}
+	}
+}
+
+func TestSectionView(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "host", "example.com")
+	c.AddOption("db", "url", "pg://%(host)s")
+	c.AddOption("db", "port", "5432")
+	c.AddOption("db", "debug", "on")
+	c.AddOption("db", "ratio", "0.5")
+	c.AddOption("db", "timeout", "3s")
+
+	db := c.Section("db")
+	if db.Name() != "db" {
+		t.Errorf("Name failure: got %q", db.Name())
+	}
+	if v, err := db.String("url"); err != nil || v != "pg://example.com" {
+		t.Errorf("String failure: got %q (%v)", v, err)
+	}
+	if v, err := db.RawString("url"); err != nil || v != "pg://%(host)s" {
+		t.Errorf("RawString failure: got %q (%v)", v, err)
+	}
+	if v, err := db.Int("port"); err != nil || v != 5432 {
+		t.Errorf("Int failure: got %d (%v)", v, err)
+	}
+	if v, err := db.Int64("port"); err != nil || v != 5432 {
+		t.Errorf("Int64 failure: got %d (%v)", v, err)
+	}
+	if v, err := db.Bool("debug"); err != nil || !v {
+		t.Errorf("Bool failure: got %v (%v)", v, err)
+	}
+	if v, err := db.Float("ratio"); err != nil || v != 0.5 {
+		t.Errorf("Float failure: got %v (%v)", v, err)
+	}
+	if v, err := db.Duration("timeout"); err != nil || v != 3*time.Second {
+		t.Errorf("Duration failure: got %v (%v)", v, err)
+	}
+	if !db.HasOption("host") || db.HasOption("none") {
+		t.Errorf("HasOption failure")
+	}
+	if opts, err := db.Options(); err != nil || len(opts) != 5 {
+		t.Errorf("Options failure: got %v (%v)", opts, err)
+	}
+
+	// A view of a missing section sees the options added later.
+	cache := c.Section("cache")
+	if _, err := cache.Int("size"); err == nil {
+		t.Errorf("Int failure: expected an error for a missing section")
+	}
+	c.AddOption("cache", "size", "10")
+	if v, err := cache.Int("size"); err != nil || v != 10 {
+		t.Errorf("Int failure: got %d (%v)", v, err)
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	const data = `# Service configuration
+# edited by hand
+
+[db]
+# Where the database runs.
+host: localhost
+port: 5432
+
+  # indented comment
+user: app
+
+[cache]
+size: 10MB
+# end of file
+`
+	c := NewDefault()
+	c.KeepComments = true
+	if err := c.read(bufio.NewReader(strings.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != data {
+		t.Errorf("WriteTo failure: not written back as read:\n%s", buf.String())
+	}
+
+	c.AddOption("db", "host", "db.example.com")
+	c.AddOption("cache", "ttl", "1m")
+	buf.Reset()
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(data, "host: localhost", "host: db.example.com", 1)
+	want = strings.Replace(want, "size: 10MB\n", "size: 10MB\nttl: 1m\n", 1)
+	if buf.String() != want {
+		t.Errorf("WriteTo failure: expected\n%s\ngot\n%s", want, buf.String())
+	}
+
+	// The comments survive a copy but are dropped with their section.
+	if clone := c.Clone(); clone.DumpString() != buf.String() {
+		t.Errorf("Clone failure: comments not copied")
+	}
+	c.RemoveSection("db")
+	if strings.Contains(c.DumpString(), "Service configuration") {
+		t.Errorf("RemoveSection failure: comments of the section kept")
+	}
+}
+
+func TestBoolStrict(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("s", "on", "TRUE")
+	c.AddOption("s", "off", "false")
+	c.AddOption("s", "one", "1")
+	c.AddOption("s", "yes", "yes")
+
+	if v, err := c.BoolStrict("s", "on"); err != nil || !v {
+		t.Errorf("BoolStrict failure: expected true, got %v (%v)", v, err)
+	}
+	if v, err := c.BoolStrict("s", "off"); err != nil || v {
+		t.Errorf("BoolStrict failure: expected false, got %v (%v)", v, err)
+	}
+	for _, option := range []string{"one", "yes"} {
+		if _, err := c.BoolStrict("s", option); err == nil {
+			t.Errorf("BoolStrict failure: %s accepted", option)
+		}
+		if _, err := c.Bool("s", option); err != nil {
+			t.Errorf("Bool failure: %s rejected: %v", option, err)
+		}
+	}
+
+	c.StrictBoolValues = map[string]bool{"yes": true, "no": false}
+	if v, err := c.BoolStrict("s", "yes"); err != nil || !v {
+		t.Errorf("BoolStrict failure: expected true for a custom value, got %v (%v)", v, err)
+	}
+	if _, err := c.BoolStrict("s", "on"); err == nil {
+		t.Errorf("BoolStrict failure: true accepted with custom values")
+	}
+}
+
+func TestAliasTag(t *testing.T) {
+	type Tconf struct {
+		Host string `config:"db-host" alias:"db:hostname, db:addr"`
+		Port int    `config:"db:port" alias:"old-port" default:"5432"`
+	}
+	c := NewDefault()
+	c.AddOption("db", "addr", "10.0.0.1")
+	c.AddOption("db", "old-port", "6543")
+	conf := new(Tconf)
+	if err := c.ParseConfStrict(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Host != "10.0.0.1" || conf.Port != 6543 {
+		t.Errorf("ParseConf failure: aliases not loaded: %+v", conf)
+	}
+
+	// The option wins over its aliases, and the first alias over the next.
+	c.AddOption("db", "hostname", "name.example.com")
+	c.AddOption("db", "port", "1")
+	conf = new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Host != "name.example.com" || conf.Port != 1 {
+		t.Errorf("ParseConf failure: wrong alias chosen: %+v", conf)
+	}
+
+	if err := c.ParseConf(&struct {
+		Host string `config:"db:host" alias:"other:host"`
+	}{}); err == nil || !strings.Contains(err.Error(), "not in section db") {
+		t.Errorf("ParseConf failure: expected an error for an alias in another section, got %v", err)
+	}
+}
+
+func TestResolved(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "root", "/srv")
+	c.AddOption("app", "dir", "%(root)s/app")
+	c.AddOption("app", "log", "%(dir)s/log")
+	c.AddSection("empty")
+
+	m, err := c.Resolved()
+	want := map[string]map[string]string{
+		DEFAULT_SECTION: {"root": "/srv"},
+		"app":           {"dir": "/srv/app", "log": "/srv/app/log"},
+		"empty":         {},
+	}
+	if err != nil || !reflect.DeepEqual(m, want) {
+		t.Errorf("Resolved failure: expected %v, got %v (%v)", want, m, err)
+	}
+
+	c.AddOption("app", "bad", "%(none)s")
+	c.AddOption("app", "loop", "%(loop)s")
+	m, err = c.Resolved()
+	if err == nil || !strings.Contains(err.Error(), "[app] bad") || !strings.Contains(err.Error(), "[app] loop") {
+		t.Errorf("Resolved failure: expected both errors, got %v", err)
+	}
+	if m["app"]["dir"] != "/srv/app" {
+		t.Errorf("Resolved failure: good options left out: %v", m)
+	}
+}
+
+func TestDigitSeparator(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("s", "grouped", "1_000_000")
+	c.AddOption("s", "plain", "1000000")
+	c.AddOption("s", "commas", "1,000,000")
+
+	for _, option := range []string{"grouped", "plain"} {
+		if v, err := c.Int("s", option); err != nil || v != 1000000 {
+			t.Errorf("Int failure for %s: got %d (%v)", option, v, err)
+		}
+	}
+	if _, err := c.Int("s", "commas"); err == nil {
+		t.Errorf("Int failure: commas accepted without DigitSeparator")
+	}
+
+	c.DigitSeparator = ","
+	if v, err := c.Int64("s", "commas"); err != nil || v != 1000000 {
+		t.Errorf("Int64 failure: got %d (%v)", v, err)
+	}
+	for _, v := range []string{"1,2,3", ",5,", ",500", "1000,000", "1,00", "1,000,"} {
+		c.AddOption("s", "bad", v)
+		if _, err := c.Int("s", "bad"); !errors.Is(err, strconv.ErrSyntax) {
+			t.Errorf("Int failure: expected a syntax error for %q, got %v", v, err)
+		}
+	}
+	c.AddOption("s", "neg", "-12,345")
+	if v, err := c.Int("s", "neg"); err != nil || v != -12345 {
+		t.Errorf("Int failure: expected -12345, got %d (%v)", v, err)
+	}
+	c.RemoveOption("s", "bad")
+	c.AddOption("s", "list", "1,000; 2,500")
+	type Tconf struct {
+		Max  uint32 `config:"s:commas"`
+		List []int  `config:"s:list" sep:";"`
+	}
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Max != 1000000 || !reflect.DeepEqual(conf.List, []int{1000, 2500}) {
+		t.Errorf("ParseConf failure: grouped integers not loaded: %+v", conf)
+	}
+	if v, err := c.IntSlice("s", "list", ";"); err != nil || !reflect.DeepEqual(v, []int{1000, 2500}) {
+		t.Errorf("IntSlice failure: got %v (%v)", v, err)
+	}
+}
+
+func TestEnum(t *testing.T) {
+	levels := []string{"debug", "info", "warn", "error"}
+	c := NewDefault()
+	c.AddOption("log", "level", "info")
+	c.AddOption("log", "upper", "WARN")
+	c.AddOption("log", "bad", "loud")
+
+	if v, err := c.Enum("log", "level", levels, false); err != nil || v != "info" {
+		t.Errorf("Enum failure: got %q (%v)", v, err)
+	}
+	if _, err := c.Enum("log", "upper", levels, false); err == nil {
+		t.Errorf("Enum failure: case-sensitive match accepted WARN")
+	}
+	if v, err := c.Enum("log", "upper", levels, true); err != nil || v != "WARN" {
+		t.Errorf("Enum failure: got %q (%v)", v, err)
+	}
+	_, err := c.Enum("log", "bad", levels, true)
+	if err == nil || !strings.Contains(err.Error(), "debug, info, warn, error") {
+		t.Errorf("Enum failure: expected the valid choices, got %v", err)
+	}
+
+	type Tconf struct {
+		Level string `config:"log:level" oneof:"debug, info,warn,error"`
+	}
+	conf := new(Tconf)
+	if err = c.ParseConf(conf); err != nil || conf.Level != "info" {
+		t.Errorf("ParseConf failure: got %+v (%v)", conf, err)
+	}
+	c.AddOption("log", "level", "loud")
+	var fe *FieldError
+	if err = c.ParseConf(new(Tconf)); !errors.As(err, &fe) || !strings.Contains(err.Error(), "expected one of") {
+		t.Errorf("ParseConf failure: expected a oneof error, got %v", err)
+	}
+}
+
+func TestAtomicParseConf(t *testing.T) {
+	type Tconf struct {
+		Host  string            `config:"db:host"`
+		Port  int               `config:"db:port"`
+		Tags  []string          `config:"db:tags"`
+		Extra map[string]string `config:"extra"`
+	}
+	c := NewDefault()
+	c.AtomicParseConf = true
+	c.AddOption("db", "host", "new")
+	c.AddOption("db", "port", "eighty")
+	c.AddOption("db", "tags", "x, y")
+	c.AddOption("extra", "k", "v")
+
+	orig := Tconf{Host: "old", Port: 1, Tags: []string{"a"}, Extra: map[string]string{"o": "p"}}
+	conf := orig
+	conf.Tags = append([]string(nil), orig.Tags...)
+	conf.Extra = map[string]string{"o": "p"}
+	if err := c.ParseConf(&conf); err == nil {
+		t.Fatal("ParseConf failure: expected an error")
+	}
+	if !reflect.DeepEqual(conf, orig) {
+		t.Errorf("ParseConf failure: struct changed after an error: %+v", conf)
+	}
+
+	// A strict error leaves it unchanged too.
+	c.AddOption("db", "port", "80")
+	c.AddOption("db", "unknown", "x")
+	if err := c.ParseConfStrict(&conf); err == nil || !reflect.DeepEqual(conf, orig) {
+		t.Errorf("ParseConfStrict failure: struct changed after an error: %+v (%v)", conf, err)
+	}
+
+	if err := c.ParseConf(&conf); err != nil {
+		t.Fatal(err)
+	}
+	want := Tconf{Host: "new", Port: 80, Tags: []string{"x", "y"}, Extra: map[string]string{"k": "v"}}
+	if !reflect.DeepEqual(conf, want) {
+		t.Errorf("ParseConf failure: expected %+v, got %+v", want, conf)
+	}
+
+	// Without AtomicParseConf the fields loaded before the error are kept.
+	c.AtomicParseConf = false
+	c.AddOption("db", "host", "partial")
+	c.AddOption("db", "port", "eighty")
+	if err := c.ParseConf(&conf); err == nil || conf.Host != "partial" {
+		t.Errorf("ParseConf failure: expected a partial load, got %+v (%v)", conf, err)
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		fname := dir + "/" + name
+		if err := os.WriteFile(fname, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	base := write("base.ini", "[db]\nhost = base\nport = 5432\nuser = app\n")
+	prod := write("prod.ini", "[db]\nhost = prod\nport = 6543\n[cache]\nsize = 1GB\n")
+	local := write("local.ini", "[db]\nhost = local\n")
+
+	c, err := ReadFiles(base, prod, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, c, "db", "host", "local")
+	testGet(t, c, "db", "port", 6543)
+	testGet(t, c, "db", "user", "app")
+	testGet(t, c, "cache", "size", "1GB")
+
+	missing := dir + "/none.ini"
+	if _, err = ReadFiles(base, missing); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadFiles failure: expected a missing file error, got %v", err)
+	}
+	if c, err = ReadOptionalFiles(base, missing, local); err != nil {
+		t.Errorf("ReadOptionalFiles failure: %v", err)
+	} else {
+		testGet(t, c, "db", "host", "local")
+		testGet(t, c, "db", "port", 5432)
+	}
+
+	bad := write("bad.ini", "[db]\nnot an option\n")
+	if _, err = ReadOptionalFiles(base, bad); err == nil || !strings.Contains(err.Error(), "bad.ini") {
+		t.Errorf("ReadFiles failure: expected an error naming the file, got %v", err)
+	}
+}
+
+func TestDurationPositive(t *testing.T) {
+	c := NewDefault()
+	c.AddOption("s", "offset", "-5m")
+	c.AddOption("s", "zero", "0s")
+	c.AddOption("s", "timeout", "30s")
+
+	if v, err := c.Duration("s", "offset"); err != nil || v != -5*time.Minute {
+		t.Errorf("Duration failure: got %v (%v)", v, err)
+	}
+	for _, option := range []string{"offset", "zero"} {
+		if _, err := c.DurationPositive("s", option); err == nil || !strings.Contains(err.Error(), "not positive") {
+			t.Errorf("DurationPositive failure for %s: expected an error, got %v", option, err)
+		}
+	}
+	if v, err := c.DurationPositive("s", "timeout"); err != nil || v != 30*time.Second {
+		t.Errorf("DurationPositive failure: got %v (%v)", v, err)
+	}
+}
+
+func TestOptionSource(t *testing.T) {
+	fname := t.TempDir() + "/source.cfg"
+	err := os.WriteFile(fname, []byte("[db]\n; comment\nhost = localhost\nport = \\\n  5432\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadDefault(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for option, want := range map[string]int{"host": 3, "port": 4} {
+		file, line, ok := c.OptionSource("db", option)
+		if !ok || file != fname || line != want {
+			t.Errorf("OptionSource failure: expected %q, %d for db %s, got %q, %d, %v", fname, want, option, file, line, ok)
+		}
+	}
+
+	c.AddOption("db", "host", "remote")
+	if _, _, ok := c.OptionSource("db", "host"); ok {
+		t.Error("OptionSource reported a source for a set option")
+	}
+	if _, _, ok := c.OptionSource("db", "missing"); ok {
+		t.Error("OptionSource reported a source for a missing option")
+	}
+
+	c, err = NewFromString("\n[s]\na = 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file, line, ok := c.OptionSource("s", "a"); !ok || file != "" || line != 3 {
+		t.Errorf("OptionSource failure: expected \"\", 3 for s a, got %q, %d, %v", file, line, ok)
+	}
+}
+
+func TestStringSet(t *testing.T) {
+	c, err := NewFromString("[s]\nfeatures =  audit, !verbose ,metrics,! debug,, \nnone = !a, !b\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enabled, disabled, err := c.StringSet("s", "features")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(enabled, []string{"audit", "metrics"}) {
+		t.Errorf("enabled = %q", enabled)
+	}
+	if !reflect.DeepEqual(disabled, []string{"verbose", "debug"}) {
+		t.Errorf("disabled = %q", disabled)
+	}
+
+	enabled, disabled, err = c.StringSet("s", "none")
+	if err != nil || enabled != nil || !reflect.DeepEqual(disabled, []string{"a", "b"}) {
+		t.Errorf("StringSet(s, none) = %q, %q, %v", enabled, disabled, err)
+	}
+	if _, _, err = c.StringSet("s", "missing"); err == nil {
+		t.Error("StringSet of a missing option did not fail")
+	}
+}
+
+func TestLoadFieldGrid(t *testing.T) {
+	type route struct {
+		Path    string
+		Handler string
+		Weight  int
+		note    string
+	}
+	var st struct {
+		Routes   []route `config:"http:routes"`
+		Repeated []route `config:"http:route"`
+		Piped    []route `config:"http:piped" sep:"|"`
+	}
+	data := "[http]\nroutes = /a, handlerA, 1; /b,handlerB,2;\n" +
+		"route = /c, handlerC, 3\nroute = /d, handlerD, 4\npiped = /e, handlerE, 5 | /f, handlerF, 6\n"
+	c := NewDefault()
+	c.AccumulateRepeated = true
+	err := c.read(bufio.NewReader(strings.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ParseConf(&st); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []route{{"/a", "handlerA", 1, ""}, {"/b", "handlerB", 2, ""}}
+	if !reflect.DeepEqual(st.Routes, want) {
+		t.Errorf("ParseConf failure: expected routes %+v, got %+v", want, st.Routes)
+	}
+	want = []route{{"/c", "handlerC", 3, ""}, {"/d", "handlerD", 4, ""}}
+	if !reflect.DeepEqual(st.Repeated, want) {
+		t.Errorf("ParseConf failure: expected repeated %+v, got %+v", want, st.Repeated)
+	}
+	want = []route{{"/e", "handlerE", 5, ""}, {"/f", "handlerF", 6, ""}}
+	if !reflect.DeepEqual(st.Piped, want) {
+		t.Errorf("ParseConf failure: expected piped %+v, got %+v", want, st.Piped)
+	}
+
+	for _, v := range []string{"/a, handlerA", "/a, handlerA, 1, extra", "/a, handlerA, x"} {
+		var bad struct {
+			Routes []route `config:"http:routes"`
+		}
+		c.AddOption("http", "routes", v)
+		if err = c.ParseConf(&bad); err == nil {
+			t.Errorf("ParseConf of %q did not fail", v)
+		}
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	c, err := NewFromString("[db]\nhost = ${DB_HOST}\nurl = ${DB_USER}@${DB_HOST}\n" +
+		"port = ${DB_PORT:-5432}\ncost = $$5\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Getenv = func(name string) string {
+		if name == "DB_HOST" {
+			return "localhost"
+		}
+		return ""
+	}
+
+	if missing := c.ValidateEnv(); !reflect.DeepEqual(missing, []string{"DB_USER"}) {
+		t.Errorf("ValidateEnv failure: expected [DB_USER], got %q", missing)
+	}
+
+	c.Getenv = func(string) string { return "set" }
+	if missing := c.ValidateEnv(); missing != nil {
+		t.Errorf("ValidateEnv failure: expected nil, got %q", missing)
+	}
+}
+
+func TestCrossSectionReference(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "scheme", "pg")
+	c.AddOption("db", "host", "db1")
+	c.AddOption("db", "port", "5432")
+	c.AddOption("db", "addr", "%(host)s:%(port)s")
+	c.AddOption("app", "host", "app1")
+	c.AddOption("app", "dsn", "%(scheme)s://%(db:addr)s from %(host)s")
+	c.AddOption("app", "missing", "%(db:user)s")
+	c.AddOption("app", "a", "%(db:b)s")
+	c.AddOption("db", "b", "%(app:a)s")
+
+	// The references in db:addr are looked up in db.
+	testGet(t, c, "app", "dsn", "pg://db1:5432 from app1")
+
+	if _, err := c.String("app", "missing"); err == nil || !strings.Contains(err.Error(), "db:user") {
+		t.Errorf("String failure: expected an error naming db:user, got %v", err)
+	}
+	if _, err := c.String("app", "a"); err == nil || !strings.Contains(err.Error(), "a -> db:b -> a") {
+		t.Errorf("String failure: expected a cycle, got %v", err)
+	}
+}
+
+func TestWriteProperties(t *testing.T) {
+	c := NewDefault()
+	c.AddOption(DEFAULT_SECTION, "host", "example.com")
+	c.AddOption("my app", "url", "http://%(host)s:80/?a=b")
+	c.AddOption("my app", "path", `C:\temp`)
+	c.AddOption("my app", "indent", "  two\nlines")
+	c.AddSection("empty")
+
+	var buf bytes.Buffer
+	if err := c.WriteProperties(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `host=example.com
+my\ app.url=http\://%(host)s\:80/?a\=b
+my\ app.path=C\:\\temp
+my\ app.indent=\ \ two\nlines
+`
+	if buf.String() != want {
+		t.Errorf("WriteProperties wrote:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestNumericBools(t *testing.T) {
+	c, err := NewFromString("[s]\none = 1.0\nzero = 0.0\nneg = -2\nyes = true\nno = false\nnan = NaN\nword = maybe\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Bool("s", "one"); err == nil {
+		t.Error("Bool accepted 1.0 without NumericBools")
+	}
+
+	c.NumericBools = true
+	for option, want := range map[string]bool{"one": true, "zero": false, "neg": true, "yes": true, "no": false} {
+		if v, err := c.Bool("s", option); err != nil || v != want {
+			t.Errorf("Bool failure: expected %v for s %s, got %v (%v)", want, option, v, err)
+		}
+	}
+	for _, option := range []string{"nan", "word"} {
+		if _, err = c.Bool("s", option); err == nil {
+			t.Errorf("Bool(s, %s) did not fail", option)
+		}
+	}
+	if _, err = c.BoolStrict("s", "one"); err == nil {
+		t.Error("BoolStrict accepted 1.0 with NumericBools")
+	}
+
+	// Get still infers numbers as numbers.
+	if v, err := c.Get("s", "neg"); err != nil || v != int64(-2) {
+		t.Errorf("Get failure: expected int64 -2, got %T %v (%v)", v, v, err)
+	}
+	if v, err := c.Get("s", "one"); err != nil || v != 1.0 {
+		t.Errorf("Get failure: expected float64 1, got %T %v (%v)", v, v, err)
+	}
+}
+
+func TestRegisterType(t *testing.T) {
+	// A type of another package, which cannot be given methods.
+	type level struct{ name string }
+	c, err := NewFromString("[log]\nlevel = WARN\nlevels = debug, info\nbad = loud\nparsed = 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RegisterType(reflect.TypeOf(level{}), func(s string) (interface{}, error) {
+		switch s := strings.ToLower(s); s {
+		case "debug", "info", "warn", "error":
+			return level{s}, nil
+		}
+		return nil, errors.New("unknown level " + s)
+	})
+	// Registered types replace the built-in conversions.
+	c.RegisterType(reflect.TypeOf(0), func(s string) (interface{}, error) {
+		return 42, nil
+	})
+
+	var st struct {
+		Level   level   `config:"log:level"`
+		Levels  []level `config:"log:levels"`
+		Pointer *level  `config:"log:level"`
+		Default level   `config:"log:missing" default:"error"`
+		Parsed  int     `config:"log:parsed"`
+	}
+	if err = c.ParseConf(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Level != (level{"warn"}) || st.Default != (level{"error"}) || st.Pointer == nil || *st.Pointer != st.Level {
+		t.Errorf("ParseConf loaded %+v", st)
+	}
+	if !reflect.DeepEqual(st.Levels, []level{{"debug"}, {"info"}}) {
+		t.Errorf("Levels = %+v", st.Levels)
+	}
+	if st.Parsed != 42 {
+		t.Errorf("ParseConf failure: expected parsed 42, got %d", st.Parsed)
+	}
+
+	var bad struct {
+		Level level `config:"log:bad"`
+	}
+	if err = c.ParseConf(&bad); err == nil || !strings.Contains(err.Error(), "unknown level loud") {
+		t.Errorf("ParseConf failure: expected the parser's error, got %v", err)
+	}
+}
+
+func TestParseSectionMapError(t *testing.T) {
+	c, err := NewFromString("[limits]\napi = 100\nweb = 200\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st struct {
+		Limits map[string]int `config:"limits"`
+	}
+	if err = c.ParseConf(&st); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"api": 100, "web": 200}; !reflect.DeepEqual(st.Limits, want) {
+		t.Errorf("ParseConf failure: expected limits %v, got %v", want, st.Limits)
+	}
+
+	c.AddOption("limits", "batch", "lots")
+	err = c.ParseConf(&st)
+	var fe *FieldError
+	if !errors.As(err, &fe) || fe.Section != "limits" || fe.Option != "batch" || fe.Kind != reflect.Map {
+		t.Fatalf("ParseConf failure: expected a FieldError for [limits] batch, got %#v", err)
+	}
+	if !strings.Contains(err.Error(), "batch") {
+		t.Errorf("error %q does not name the key", err)
+	}
+
+	var ports struct {
+		Ports map[int]string `config:"limits"`
+	}
+	if err = c.ParseConf(&ports); err == nil || !strings.Contains(err.Error(), "invalid key") {
+		t.Errorf("ParseConf failure: expected an invalid key, got %v", err)
+	}
+}
+
+func TestStringMap(t *testing.T) {
+	c, err := NewFromString("[s]\nlabels = env=prod, team = core,,\nlinks = a:1; b:2=x\nbad = env=prod, team\nempty = =x\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := c.StringMap("s", "labels", "", "")
+	if want := map[string]string{"env": "prod", "team": "core"}; err != nil || !reflect.DeepEqual(m, want) {
+		t.Errorf("StringMap failure: expected %v for s labels, got %v (%v)", want, m, err)
+	}
+	m, err = c.StringMap("s", "links", ";", ":")
+	if want := map[string]string{"a": "1", "b": "2=x"}; err != nil || !reflect.DeepEqual(m, want) {
+		t.Errorf("StringMap failure: expected %v for s links, got %v (%v)", want, m, err)
+	}
+	for _, option := range []string{"bad", "empty"} {
+		if _, err = c.StringMap("s", option, "", ""); err == nil {
+			t.Errorf("StringMap(s, %s) did not fail", option)
+		}
+	}
+
+	var st struct {
+		Labels map[string]string `config:"s:labels"`
+		Links  map[string]int    `config:"s:links" sep:";" kvsep:":"`
+		None   map[string]string `config:"s:none"`
+	}
+	c.AddOption("s", "links", "a:1; b:2")
+	if err = c.ParseConf(&st); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"env": "prod", "team": "core"}; !reflect.DeepEqual(st.Labels, want) {
+		t.Errorf("ParseConf failure: expected labels %v, got %v", want, st.Labels)
+	}
+	if want := map[string]int{"a": 1, "b": 2}; !reflect.DeepEqual(st.Links, want) {
+		t.Errorf("ParseConf failure: expected links %v, got %v", want, st.Links)
+	}
+	if st.None != nil {
+		t.Errorf("ParseConf failure: expected no map, got %v", st.None)
+	}
+
+	var bad struct {
+		Bad map[string]string `config:"s:bad"`
+	}
+	if err = c.ParseConf(&bad); err == nil || !strings.Contains(err.Error(), "malformed pair") {
+		t.Errorf("ParseConf failure: expected a malformed pair, got %v", err)
+	}
+}
+
+func TestFallbackTag(t *testing.T) {
+	c, err := NewFromString("[db]\nhost = db1\nport = 5432\nmax_conns = 10\nuser = admin\nsecret = x\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type database struct {
+		Address  string `json:"host"`
+		Number   int    `json:"port,omitempty"`
+		MaxConns int    `json:",omitempty"`
+		Login    string `json:"login" config:":user"`
+		Secret   string `json:"-"`
+	}
+
+	var st database
+	if err = c.ParseConfSection(&st, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (database{"", 0, 10, "admin", "x"}); st != want {
+		t.Errorf("ParseConfSection failure: expected %+v without FallbackTag, got %+v", want, st)
+	}
+
+	c.FallbackTag = "json"
+	st = database{}
+	if err = c.ParseConfSection(&st, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (database{"db1", 5432, 10, "admin", ""}); st != want {
+		t.Errorf("ParseConfSection failure: expected %+v, got %+v", want, st)
+	}
+
+	// Without a section the json tags are ignored.
+	var top struct {
+		Host string `json:"host"`
+	}
+	if err = c.ParseConf(&top); err != nil || top.Host != "" {
+		t.Errorf("ParseConf = %+v, %v", top, err)
+	}
+}
+
+func TestColor(t *testing.T) {
+	// "#" starts a comment, unless quoted.
+	c, err := NewFromString("[ui]\nshort = \"#f80\"\nlong = \"#FF8800\"\nalpha = \"#ff880080\"\n" +
+		"base = \"#102030\"\nbg = %(base)s\nbad = \"#ff88zz\"\nnohash = ff8800\nodd = \"#ff88\"\n" +
+		"unquoted = #ff0000\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for option, want := range map[string]color.RGBA{
+		"short": {0xff, 0x88, 0x00, 0xff},
+		"long":  {0xff, 0x88, 0x00, 0xff},
+		"alpha": {0xff, 0x88, 0x00, 0x80},
+		"bg":    {0x10, 0x20, 0x30, 0xff},
+	} {
+		if v, err := c.Color("ui", option); err != nil || v != want {
+			t.Errorf("Color failure: expected %v for ui %s, got %v (%v)", want, option, v, err)
+		}
+	}
+	for _, option := range []string{"bad", "nohash", "odd"} {
+		if _, err = c.Color("ui", option); err == nil || !strings.Contains(err.Error(), "invalid color") {
+			t.Errorf("Color failure: expected an invalid color for ui %s, got %v", option, err)
+		}
+	}
+	// An unquoted color is read as a comment, leaving the value empty.
+	if _, err = c.Color("ui", "unquoted"); err == nil || !strings.Contains(err.Error(), "must be quoted") {
+		t.Errorf("Color failure: expected the color to be quoted, got %v", err)
+	}
+
+	var st struct {
+		Bg      color.RGBA   `config:"ui:alpha"`
+		Palette []color.RGBA `config:"ui:palette"`
+		Default color.RGBA   `config:"ui:missing" default:"#000"`
+	}
+	c.AddOption("ui", "palette", "#fff, #000000")
+	if err = c.ParseConf(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Bg != (color.RGBA{0xff, 0x88, 0x00, 0x80}) || st.Default != (color.RGBA{0, 0, 0, 0xff}) {
+		t.Errorf("ParseConf loaded %+v", st)
+	}
+	if want := []color.RGBA{{0xff, 0xff, 0xff, 0xff}, {0, 0, 0, 0xff}}; !reflect.DeepEqual(st.Palette, want) {
+		t.Errorf("ParseConf failure: expected palette %v, got %v", want, st.Palette)
+	}
+}
+
+func TestMust(t *testing.T) {
+	c, err := NewFromString("[app]\nname = demo\nport = 8080\nverbose = on\nratio = 0.5\ntimeout = 3s\nbad = x\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MustString("app", "name") != "demo" || c.MustInt("app", "port") != 8080 ||
+		c.MustInt64("app", "port") != 8080 || !c.MustBool("app", "verbose") ||
+		c.MustFloat("app", "ratio") != 0.5 || c.MustDuration("app", "timeout") != 3*time.Second {
+		t.Error("Must getters returned wrong values")
+	}
+
+	mustPanic := func(name string, f func()) {
+		t.Helper()
+		defer func() {
+			r := recover()
+			if msg, ok := r.(string); !ok || !strings.Contains(msg, "[app] "+name) {
+				t.Errorf("Must failure: expected a panic naming [app] %s, got %v", name, r)
+			}
+		}()
+		f()
+	}
+	mustPanic("missing", func() { c.MustString("app", "missing") })
+	mustPanic("bad", func() { c.MustInt("app", "bad") })
+	mustPanic("bad", func() { c.MustBool("app", "bad") })
+	mustPanic("bad", func() { c.MustDuration("app", "bad") })
+}
+
+type ptrDatabase struct {
+	Host string `config:":host"`
+	Port int    `config:":port" default:"5432"`
+	User string `config:":user" required:"true"`
+}
+
+type PtrCache struct {
+	Size int `config:"cache:size"`
+}
+
+func (p *PtrCache) Validate() error {
+	if p.Size < 0 {
+		return errors.New("negative cache size")
+	}
+	return nil
+}
+
+func TestLoadStructPointer(t *testing.T) {
+	c, err := NewFromString("[DEFAULT]\nhost = fallback\n[db]\nhost = db1\nuser = admin\n[other]\nkey = v\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st struct {
+		DB      *ptrDatabase `config:"db"`
+		Replica *ptrDatabase `config:"replica"`
+		*PtrCache
+	}
+	if err = c.ParseConfStrict(&st); err == nil || !strings.Contains(err.Error(), "[other] key") {
+		t.Fatalf("ParseConfStrict failure: expected only [other] key unknown, got %v", err)
+	}
+	if st.DB == nil || *st.DB != (ptrDatabase{"db1", 5432, "admin"}) {
+		t.Errorf("ParseConf failure: expected the partial block with defaults, got %+v", st.DB)
+	}
+	// The default section alone does not make a block present.
+	if st.Replica != nil || st.PtrCache != nil {
+		t.Errorf("ParseConf failure: expected nil blocks, got %+v and %+v", st.Replica, st.PtrCache)
+	}
+
+	c.AddOption("cache", "size", "64")
+	c.AddOption("replica", "port", "5433")
+	if err = c.ParseConf(&st); err == nil || !strings.Contains(err.Error(), "required") {
+		t.Errorf("ParseConf failure: expected the required user of replica, got %v", err)
+	}
+	if st.PtrCache == nil || st.PtrCache.Size != 64 {
+		t.Errorf("ParseConf failure: expected cache size 64, got %+v", st.PtrCache)
+	}
+
+	// The Validate promoted from a block is called only if it is present.
+	var cached struct {
+		*PtrCache
+	}
+	if err = NewDefault().ParseConf(&cached); err != nil || cached.PtrCache != nil {
+		t.Errorf("ParseConf of an absent block = %+v, %v", cached.PtrCache, err)
+	}
+	c.AddOption("cache", "size", "-1")
+	if err = c.ParseConf(&cached); err == nil || !strings.Contains(err.Error(), "negative cache size") {
+		t.Errorf("ParseConf failure: expected the block's Validate error, got %v", err)
+	}
+	if st.Replica == nil || st.Replica.Port != 5433 {
+		t.Errorf("ParseConf failure: expected replica port 5433, got %+v", st.Replica)
+	}
+}
+
+func TestParseConfUnsettable(t *testing.T) {
+	c, err := NewFromString("[db]\nhost = db1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type conf struct {
+		Host string `config:"db:host"`
+	}
+
+	err = c.ParseConf(conf{})
+	if !errors.Is(err, ErrUnsupportedType) || !strings.Contains(err.Error(), "pass a pointer") {
+		t.Errorf("ParseConf failure: expected a hint to pass a pointer for a struct value, got %v", err)
+	}
+
+	// A pointer to a pointer is followed.
+	p := &conf{}
+	if err = c.ParseConf(&p); err != nil || p.Host != "db1" {
+		t.Errorf("ParseConf(**conf) = %+v, %v", p, err)
+	}
+
+	var unexported struct {
+		Host string `config:"db:host"`
+		host string `config:"db:host"`
+	}
+	err = c.ParseConf(&unexported)
+	if err == nil || !strings.Contains(err.Error(), "field host is not settable") {
+		t.Errorf("ParseConf failure: expected field host not settable, got %v", err)
+	}
+	if unexported.Host != "db1" {
+		t.Errorf("ParseConf failure: expected the exported field loaded, got host %q", unexported.Host)
+	}
+}
+
+func TestDisableEnvSubstitution(t *testing.T) {
+	c, err := NewFromString("[s]\nhome = ${HOME}\npath = %(home)s/bin:${EXTRA:-/usr/bin}\ncost = $$5\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Getenv = func(name string) string { return "/secret/" + name }
+	testGet(t, c, "s", "home", "/secret/HOME")
+
+	c.DisableEnvSubstitution = true
+	testGet(t, c, "s", "home", "${HOME}")
+	// %(variable)s references are still unfolded.
+	testGet(t, c, "s", "path", "${HOME}/bin:${EXTRA:-/usr/bin}")
+	testGet(t, c, "s", "cost", "$$5")
+	if missing := c.ValidateEnv(); missing != nil {
+		t.Errorf("ValidateEnv failure: expected nil, got %q", missing)
+	}
+	if !c.Clone().DisableEnvSubstitution {
+		t.Error("Clone did not copy DisableEnvSubstitution")
+	}
+}
+
+func TestParseDottedTagDashes(t *testing.T) {
+	type Tconf struct {
+		Pool    int    `config:"db.pool-size"`
+		Host    string `config:"my-service.host"`
+		Both    string `config:"my-service.max-conns"`
+		Legacy  string `config:"legacy:pool.size"`
+		Dotted  string `config:"legacy-pool.size"`
+		Missing string `config:"no-such.option"`
+	}
+	c := NewDefault()
+	c.AddOption("db", "pool-size", "8")
+	c.AddOption("my-service", "host", "svc1")
+	c.AddOption("my-service", "max-conns", "10")
+	c.AddOption("legacy", "pool.size", "4")
+	c.AddOption("legacy-pool", "size", "5")
+
+	conf := new(Tconf)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Tconf{8, "svc1", "10", "4", "5", ""}); *conf != want {
+		t.Errorf("ParseConf failure: got %+v, expected %+v", *conf, want)
+	}
+}
+
+func TestTrailingBackslash(t *testing.T) {
+	c, err := NewFromString("[s]\ndir = C:\\tmp\\\\\nother = x\n# C:\\\nnext = y\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, c, "s", "dir", `C:\tmp\`)
+	testGet(t, c, "s", "other", "x")
+	// A comment ending with a backslash does not swallow the next line.
+	testGet(t, c, "s", "next", "y")
+
+	c = NewDefault()
+	c.AddOption("s", "dir", `C:\tmp\`)
+	c.AddOption("s", "lines", "a\\\nb")
+	c.AddOption("s", "other", "x")
+	var buf bytes.Buffer
+	if _, err = c.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGet(t, r, "s", "dir", `C:\tmp\`)
+	testGet(t, r, "s", "lines", "a\\\nb")
+	testGet(t, r, "s", "other", "x")
+}
+
+func TestWriteCommentChars(t *testing.T) {
+	c, err := NewFromString("[s]\nquoted = \"a ; b\" ; comment\nhash = \"#x\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Comments are stripped after the quotes are found.
+	testGet(t, c, "s", "quoted", "a ; b")
+	testGet(t, c, "s", "hash", "#x")
+
+	for _, v := range []string{"a #b", "a ; b", "#x", ";x", `a \#b`, "x\n#y", "  a ; b  ", "a#b", "a\n  b\n\nc"} {
+		c.AddOption("s", "v", v)
+		var buf bytes.Buffer
+		if _, err = c.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		r, err := ReadFrom(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := r.RawString("s", "v"); err != nil || got != v {
+			t.Errorf("WriteTo round trip of %q: got %q, %v", v, got, err)
+		}
+	}
+}
+
+func TestOneOfElements(t *testing.T) {
+	c := NewDefault()
+	c.AccumulateRepeated = true
+	data := "[s]\nlist = x, y\narr = y,x\nbad = x, z\nrep = x\nrep = z\n"
+	if err := c.read(bufio.NewReader(strings.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	var st struct {
+		List []string  `config:"s:list" oneof:"x,y"`
+		Arr  [2]string `config:"s:arr" oneof:"x,y"`
+		Def  []string  `config:"s:missing" oneof:"x,y" default:"y"`
+	}
+	if err := c.ParseConf(&st); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(st.List, []string{"x", "y"}) || st.Arr != [2]string{"y", "x"} || !reflect.DeepEqual(st.Def, []string{"y"}) {
+		t.Errorf("ParseConf failure: got %+v", st)
+	}
+
+	for _, v := range []interface{}{
+		&struct {
+			Bad []string `config:"s:bad" oneof:"x,y"`
+		}{},
+		&struct {
+			Rep []string `config:"s:rep" oneof:"x,y"`
+		}{},
+		&struct {
+			Def string `config:"s:missing" oneof:"x,y" default:"z"`
+		}{},
+	} {
+		if err := c.ParseConf(v); err == nil || !strings.Contains(err.Error(), `invalid value "z"`) {
+			t.Errorf("ParseConf failure: expected a oneof error for %T, got %v", v, err)
+		}
+	}
+}
+
+func TestMergeConcurrent(t *testing.T) {
+	a, b := NewDefault(), NewDefault()
+	a.AddOption("a", "x", "1")
+	b.AddOption("b", "y", "2")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); a.Merge(b) }()
+		go func() { defer wg.Done(); b.Merge(a) }()
+	}
+	wg.Wait()
+	testGet(t, a, "b", "y", "2")
+	testGet(t, b, "a", "x", "1")
+}
+
+type NilDefaultsInner struct {
+	Level  string `config:"log:level"`
+	Format string `config:"log:format"`
+}
+
+func (p *NilDefaultsInner) Defaults() {
+	p.Level = "info"
+	p.Format = "text"
+}
+
+func TestDefaulterNilEmbedded(t *testing.T) {
+	type Outer struct {
+		*NilDefaultsInner
+		Name string `config:"app:name"`
+	}
+	c := NewDefault()
+	c.AddOption("app", "name", "demo")
+
+	conf := new(Outer)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Name != "demo" || conf.NilDefaultsInner != nil {
+		t.Errorf("ParseConf failure: expected a nil block, got %+v", conf)
+	}
+
+	// Defaults is called on the block allocated for its options.
+	c.AddOption("log", "level", "debug")
+	conf = new(Outer)
+	if err := c.ParseConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.NilDefaultsInner == nil || *conf.NilDefaultsInner != (NilDefaultsInner{"debug", "text"}) {
+		t.Errorf("ParseConf failure: expected the block with its defaults, got %+v", conf.NilDefaultsInner)
+	}
+}
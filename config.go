@@ -15,18 +15,26 @@
 package config
 
 import (
+	"fmt"
+	"math"
+	"os"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
 	// Default section name.
 	DEFAULT_SECTION = "DEFAULT"
-	// Maximum allowed depth when recursively substituing variable names.
+	// Maximum allowed depth when recursively substituting variable names.
 	_DEPTH_VALUES = 200
 
 	DEFAULT_COMMENT       = "# "
 	ALTERNATIVE_COMMENT   = "; "
+	DEFAULT_COMMENT_CHARS = "#;"
 	DEFAULT_SEPARATOR     = ":"
 	ALTERNATIVE_SEPARATOR = "="
 )
@@ -48,12 +56,98 @@ var (
 		"0":     false,
 	}
 
-	varRegExp    = regexp.MustCompile(`%\(([a-zA-Z0-9_.\-]+)\)s`) // %(variable)s
-	envVarRegExp = regexp.MustCompile(`\${([a-zA-Z0-9_.\-]+)}`)   // ${envvar}
+	// Strings accepted as boolean by BoolStrict by default.
+	strictBoolString = map[string]bool{"true": true, "false": false}
+
+	// A doubled sigil ("%%(" and "$$") is an escape which unfolds to a single
+	// one, without any variable.
+	varRegExp    = regexp.MustCompile(`%%\(|%\(((?:[^:()%]+:)?[a-zA-Z0-9_.\-]+)\)s`) // %(variable)s or %(section:variable)s
+	envVarRegExp = regexp.MustCompile(`\$\$|\${([a-zA-Z0-9_.\-]+(?::-[^}]*)?)}`)     // ${envvar} or ${envvar:-default}
 )
 
 // Config is the representation of configuration settings.
+// It is safe for concurrent use by multiple goroutines.
 type Config struct {
+	// MaxUnfoldDepth is the maximum depth of nested variable references that
+	// String unfolds. If it is not positive, _DEPTH_VALUES is used. It must be
+	// set before the configuration is used concurrently.
+	MaxUnfoldDepth int
+
+	// EnvPrefix, if not empty, lets environment variables override options:
+	// the value of option "db-host" in section "my app" is then taken from
+	// PREFIX_MY_APP_DB_HOST if that variable is set (even to the empty
+	// string), and from PREFIX_DB_HOST for the default section. The variable
+	// name is upper case, with any character other than ASCII letters and
+	// digits replaced by an underscore. It must be set before the
+	// configuration is used concurrently.
+	EnvPrefix string
+
+	// CommentChars are the characters which start a comment when reading,
+	// either at the beginning of a line or after a space or TAB. If empty,
+	// DEFAULT_COMMENT_CHARS is used.
+	CommentChars string
+
+	// Getenv, if not nil, replaces os.Getenv for the ${VAR} references and
+	// the EnvPrefix overrides, e.g. to give a fake environment to tests. An
+	// EnvPrefix variable then only overrides an option if it is not empty. It
+	// must be set before the configuration is used concurrently.
+	Getenv func(string) string
+
+	// DisableEnvSubstitution makes String and the other getters leave the
+	// ${VAR} references, and "$$", as they are written, so that no value
+	// reads the environment. The %(variable)s references are still unfolded.
+	// It does not affect EnvPrefix. It must be set before the configuration
+	// is used concurrently.
+	DisableEnvSubstitution bool
+
+	// AccumulateRepeated makes an option repeated within a section of a file
+	// keep all its values, in order, instead of only the last one; see Values.
+	// A slice field loaded from such an option gets one element per value,
+	// and the values are not split on commas (or "sep") then. It must be set
+	// before reading.
+	AccumulateRepeated bool
+
+	// KeepComments makes reading keep the whole-line comments and the blank
+	// lines, attached to the section or option which follows them, so that
+	// writing reproduces them around the values, e.g. to edit a file. Comments
+	// after a value are not kept. Overwriting an option with AddOption then
+	// keeps its place and comments. It must be set before reading.
+	KeepComments bool
+
+	// StrictBoolValues are the strings accepted by BoolStrict, with the bool
+	// they stand for, in lower case. If nil, only "true" and "false" are. It
+	// must be set before the configuration is used concurrently.
+	StrictBoolValues map[string]bool
+
+	// DigitSeparator, if not empty, is removed from integers before they are
+	// parsed, e.g. "," for "1,000,000". Underscores are always accepted
+	// between digits, as in Go literals ("1_000_000"). With ",", lists of
+	// integers need another separator, such as a "sep" tag. It must be set
+	// before the configuration is used concurrently.
+	DigitSeparator string
+
+	// AtomicParseConf makes ParseConf and its variants leave the struct
+	// unchanged when they return an error, including one from the strict
+	// check or from Validate, instead of keeping the fields loaded until
+	// then.
+	AtomicParseConf bool
+
+	// NumericBools makes Bool, and the other conversions to bool but
+	// BoolStrict, accept the numbers which are not among the strings
+	// accepted, such as "1.0": zero is false and any other number true. It
+	// must be set before the configuration is used concurrently.
+	NumericBools bool
+
+	// FallbackTag, if not empty, is the name of a struct tag, such as "json",
+	// which names the option of the fields without a "config" tag when a
+	// section is known, as with ParseConfSection: with "json", a field tagged
+	// `json:"host,omitempty"` is read from option "host" of the section. A
+	// "config" tag always wins, and "-" skips the field. It must be set
+	// before the configuration is used concurrently.
+	FallbackTag string
+
+	mu sync.RWMutex // Guards the fields below
+
 	comment   string
 	separator string
 
@@ -66,12 +160,30 @@ type Config struct {
 
 	// Section -> option : value
 	data map[string]map[string]*tValue
+
+	// Lines kept with KeepComments: those before each section header, and
+	// those after the last option.
+	sectionComments map[string][]string
+	trailer         []string
+
+	// Strings accepted as bool, when extended by RegisterBoolValues.
+	boolString map[string]bool
+
+	// Parsers of the types registered by RegisterType.
+	types map[reflect.Type]func(string) (interface{}, error)
+
+	// Set at construction by NewWithOptions; it is never changed afterwards.
+	caseInsensitive bool
 }
 
 // tValue holds the input position for a value.
 type tValue struct {
-	position int    // Option order
-	v        string // value
+	position int      // Option order
+	v        string   // value
+	vs       []string // All the values, last one included, if repeated
+	comments []string // Lines before the option, with KeepComments
+	file     string   // Source file, if read from one
+	line     int      // Source line, if read
 }
 
 // New creates an empty configuration representation.
@@ -121,31 +233,367 @@ func NewDefault() *Config {
 	return New(DEFAULT_COMMENT, DEFAULT_SEPARATOR, false, true)
 }
 
+// NewWithOptions creates a configuration representation with values by
+// default, like NewDefault.
+//
+// If caseInsensitive is true, section and option names are folded to lower
+// case (except for the default section) both when they are stored and when they
+// are looked up, so "[Database]" and "[database]" are the same section. Names
+// are then returned in lower case, and among options that only differ in case
+// the last one written wins.
+func NewWithOptions(caseInsensitive bool) *Config {
+	c := NewDefault()
+	c.caseInsensitive = caseInsensitive
+	return c
+}
+
 // Merge merges the given configuration "source" with this one ("target").
 //
-// Merging means that any option (under any section) from source that is not in
-// target will be copied into target. When the target already has an option with
-// the same name and section then it is overwritten (i.o.w. the source wins).
+// Merging means that any section, or option under any section (including the
+// default one), from source that is not in target will be copied into target,
+// following the input order of source. When the target already has an option
+// with the same name and section then it is overwritten (i.o.w. the source
+// wins). Sections and options only in target are kept.
 func (target *Config) Merge(source *Config) {
-	if source == nil || source.data == nil || len(source.data) == 0 {
+	if source == nil || source == target {
+		return
+	}
+
+	// A copy, so that the two locks are never held at once.
+	source = source.Clone()
+
+	for _, section := range source.sections() {
+		target.AddSection(section)
+		for _, option := range source.orderedOptions(section) {
+			tValue := source.data[section][option]
+			target.AddOption(section, option, tValue.v)
+
+			// The values of a repeated option and the source go along.
+			target.mu.Lock()
+			if tv, ok := target.data[target.sectionKey(section)][target.optionKey(option)]; ok {
+				tv.vs = tValue.vs
+				tv.file, tv.line = tValue.file, tValue.line
+			}
+			target.mu.Unlock()
+		}
+	}
+}
+
+// Diff compares the raw values of two configurations, e.g. before and after a
+// reload. It returns the "section.option" paths of the options only in b
+// (added), only in a (removed), and in both with different values (changed),
+// each sorted.
+func Diff(a, b *Config) (added, removed, changed []string) {
+	// Copies, so that the two locks are never held at once.
+	a, b = a.Clone(), b.Clone()
+
+	for section, options := range b.data {
+		for option, bv := range options {
+			av, ok := a.data[section][option]
+			switch {
+			case !ok:
+				added = append(added, section+"."+option)
+			case av.v != bv.v:
+				changed = append(changed, section+"."+option)
+			}
+		}
+	}
+	for section, options := range a.data {
+		for option := range options {
+			if _, ok := b.data[section][option]; !ok {
+				removed = append(removed, section+"."+option)
+			}
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	return added, removed, changed
+}
+
+// Clone returns a deep copy of the configuration, so that changes to either
+// one do not affect the other.
+func (c *Config) Clone() *Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	clone := &Config{
+		MaxUnfoldDepth:         c.MaxUnfoldDepth,
+		EnvPrefix:              c.EnvPrefix,
+		CommentChars:           c.CommentChars,
+		Getenv:                 c.Getenv,
+		DisableEnvSubstitution: c.DisableEnvSubstitution,
+		AccumulateRepeated:     c.AccumulateRepeated,
+		KeepComments:           c.KeepComments,
+		StrictBoolValues:       c.StrictBoolValues,
+		DigitSeparator:         c.DigitSeparator,
+		AtomicParseConf:        c.AtomicParseConf,
+		NumericBools:           c.NumericBools,
+		FallbackTag:            c.FallbackTag,
+		comment:                c.comment,
+		separator:              c.separator,
+		lastIdSection:          c.lastIdSection,
+		idSection:              make(map[string]int, len(c.idSection)),
+		lastIdOption:           make(map[string]int, len(c.lastIdOption)),
+		data:                   make(map[string]map[string]*tValue, len(c.data)),
+		caseInsensitive:        c.caseInsensitive,
+	}
+	for section, id := range c.idSection {
+		clone.idSection[section] = id
+	}
+	for section, id := range c.lastIdOption {
+		clone.lastIdOption[section] = id
+	}
+	for section, options := range c.data {
+		clone.data[section] = make(map[string]*tValue, len(options))
+		for option, tValue := range options {
+			v := *tValue
+			v.vs = append([]string(nil), tValue.vs...)
+			v.comments = append([]string(nil), tValue.comments...)
+			clone.data[section][option] = &v
+		}
+	}
+	if c.trailer != nil {
+		clone.trailer = append([]string{}, c.trailer...)
+	}
+	if c.sectionComments != nil {
+		clone.sectionComments = make(map[string][]string, len(c.sectionComments))
+		for section, lines := range c.sectionComments {
+			clone.sectionComments[section] = append([]string{}, lines...)
+		}
+	}
+	if c.boolString != nil {
+		clone.boolString = make(map[string]bool, len(c.boolString))
+		for k, v := range c.boolString {
+			clone.boolString[k] = v
+		}
+	}
+	if c.types != nil {
+		clone.types = make(map[reflect.Type]func(string) (interface{}, error), len(c.types))
+		for t, parse := range c.types {
+			clone.types[t] = parse
+		}
+	}
+
+	return clone
+}
+
+// ReplaceData replaces all the sections and options of the configuration by a
+// copy of those of other, e.g. freshly read for a reload. It is done at once,
+// so concurrent readers see either the old or the new options, never a mix.
+// The other settings, such as the case sensitivity, are kept; other should
+// have the same.
+func (c *Config) ReplaceData(other *Config) {
+	if other == c {
 		return
 	}
+	clone := other.Clone()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.data = clone.data
+	c.idSection = clone.idSection
+	c.lastIdSection = clone.lastIdSection
+	c.lastIdOption = clone.lastIdOption
+	c.sectionComments = clone.sectionComments
+	c.trailer = clone.trailer
+}
+
+// RegisterBoolValues adds strings to be accepted as true (truthy) and as false
+// (falsy) by Bool and when loading bool fields, in addition to those in
+// "boolString". The matching is case-insensitive.
+func (c *Config) RegisterBoolValues(truthy, falsy []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.boolString == nil {
+		c.boolString = make(map[string]bool, len(boolString)+len(truthy)+len(falsy))
+		for k, v := range boolString {
+			c.boolString[k] = v
+		}
+	}
+	for _, s := range truthy {
+		c.boolString[strings.ToLower(s)] = true
+	}
+	for _, s := range falsy {
+		c.boolString[strings.ToLower(s)] = false
+	}
+}
+
+// RegisterType sets the parser of the values of type typ, for the struct
+// fields loaded by ParseConf and its variants, including the elements of
+// slices and maps and the targets of pointers. It comes before the built-in
+// conversions, so it also replaces them, e.g. for types which cannot be made
+// to implement encoding.TextUnmarshaler. The parser must return a value of
+// type typ, or an error. A nil parse removes the parser.
+func (c *Config) RegisterType(typ reflect.Type, parse func(string) (interface{}, error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if parse == nil {
+		delete(c.types, typ)
+		return
+	}
+	if c.types == nil {
+		c.types = make(map[reflect.Type]func(string) (interface{}, error))
+	}
+	c.types[typ] = parse
+}
+
+// parseType converts v with the parser registered for t, if any.
+func (c *Config) parseType(t reflect.Type, v string) (value reflect.Value, ok bool, err error) {
+	c.mu.RLock()
+	parse, ok := c.types[t]
+	c.mu.RUnlock()
+	if !ok {
+		return reflect.Value{}, false, nil
+	}
+
+	i, err := parse(v)
+	if err != nil {
+		return reflect.Value{}, true, err
+	}
+	value = reflect.ValueOf(i)
+	if !value.IsValid() || !value.Type().AssignableTo(t) {
+		return reflect.Value{}, true, fmt.Errorf("parser of %s returned %T", t, i)
+	}
+	return value, true, nil
+}
+
+// boolValue looks up s in the strings accepted as bool, and parses it as a
+// number with NumericBools.
+func (c *Config) boolValue(s string) (value bool, ok bool) {
+	if value, ok = c.boolStringValue(s); ok || !c.NumericBools {
+		return value, ok
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) {
+		return f != 0, true
+	}
+	return false, false
+}
+
+// boolStringValue looks up s in the strings accepted as bool only.
+func (c *Config) boolStringValue(s string) (value bool, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.boolString != nil {
+		value, ok = c.boolString[strings.ToLower(s)]
+	} else {
+		value, ok = boolString[strings.ToLower(s)]
+	}
+	return value, ok
+}
+
+// maxUnfoldDepth returns the maximum depth of nested variable references.
+func (c *Config) maxUnfoldDepth() int {
+	if c.MaxUnfoldDepth > 0 {
+		return c.MaxUnfoldDepth
+	}
+	return _DEPTH_VALUES
+}
+
+// envOption returns the value of the environment variable which overrides the
+// option, if EnvPrefix is set; see EnvPrefix.
+func (c *Config) envOption(section string, option string) (string, bool) {
+	if c.EnvPrefix == "" {
+		return "", false
+	}
 
-	for section, option := range source.data {
-		for optionName, optionValue := range option {
-			target.AddOption(section, optionName, optionValue.v)
+	name := c.EnvPrefix + "_"
+	if section != DEFAULT_SECTION {
+		name += section + "_"
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
 		}
+		return '_'
+	}, name+option)
+
+	return c.lookupEnv(name)
+}
+
+// lookupEnv returns the value of the environment variable, and whether it is
+// set, through Getenv if it is not nil.
+func (c *Config) lookupEnv(name string) (string, bool) {
+	if c.Getenv != nil {
+		v := c.Getenv(name)
+		return v, v != ""
 	}
+	return os.LookupEnv(name)
+}
+
+// commentChars returns the characters which start a comment when reading.
+func (c *Config) commentChars() string {
+	if c.CommentChars != "" {
+		return c.CommentChars
+	}
+	return DEFAULT_COMMENT_CHARS
+}
+
+// sectionKey returns the name under which the section is stored.
+func (c *Config) sectionKey(section string) string {
+	if !c.caseInsensitive {
+		return section
+	}
+	if strings.EqualFold(section, DEFAULT_SECTION) {
+		return DEFAULT_SECTION
+	}
+	return strings.ToLower(section)
+}
+
+// optionKey returns the name under which the option is stored.
+func (c *Config) optionKey(option string) string {
+	if !c.caseInsensitive {
+		return option
+	}
+	return strings.ToLower(option)
 }
 
 // == Utility
 
-func stripComments(l string) string {
-	// Comments are preceded by space or TAB
-	for _, c := range []string{" ;", "\t;", " #", "\t#"} {
-		if i := strings.Index(l, c); i != -1 {
-			l = l[0:i]
+// closingQuote returns the index of the double quote closing the one at i in
+// l, skipping the escaped characters, or -1 if there is none.
+func closingQuote(l string, i int) int {
+	for j := i + 1; j < len(l); j++ {
+		switch l[j] {
+		case '\\':
+			j++
+		case '"':
+			return j
+		}
+	}
+	return -1
+}
+
+// stripComments removes a trailing comment from l. Comments start with one of
+// the characters in chars preceded by space or TAB, so "http://x/#frag" is
+// kept whole. A comment character escaped with a backslash is kept literally,
+// without the backslash. A value between double quotes, right after the
+// separator, is kept whole up to the closing quote, for unquoteValue.
+func stripComments(l string, chars string) string {
+	var buf strings.Builder
+	sep := strings.IndexAny(l, "=:")
+	for i := 0; i < len(l); i++ {
+		switch ch := l[i]; {
+		case ch == '"' && sep != -1 && i > sep && strings.TrimSpace(l[sep+1:i]) == "" && closingQuote(l, i) != -1:
+			j := closingQuote(l, i)
+			buf.WriteString(l[i : j+1])
+			i = j
+		case ch == '\\' && i+1 < len(l) && strings.IndexByte(chars, l[i+1]) != -1:
+			i++
+			buf.WriteByte(l[i])
+		case strings.IndexByte(chars, ch) != -1 && i > 0 && (l[i-1] == ' ' || l[i-1] == '\t'):
+			return buf.String()
+		default:
+			buf.WriteByte(ch)
 		}
 	}
-	return l
+	return buf.String()
 }
@@ -0,0 +1,106 @@
+// Copyright 2009  The "config" Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strconv"
+	"time"
+)
+
+// The getters below return the given default "def" when the option does not
+// exist or its value cannot be converted. Other errors, such as a cycle while
+// unfolding variables, are returned along with the default.
+
+// lookup returns the unfolded value of the option and whether it was found.
+func (c *Config) lookup(section string, option string) (value string, ok bool, err error) {
+	value, err = c.String(section, option)
+	if isNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// StringDefault has the same behaviour as String but returns def when the
+// option does not exist.
+func (c *Config) StringDefault(section string, option string, def string) (string, error) {
+	sv, ok, err := c.lookup(section, option)
+	if !ok {
+		return def, err
+	}
+	return sv, nil
+}
+
+// BoolDefault has the same behaviour as Bool but returns def when the option
+// does not exist or is not a bool.
+func (c *Config) BoolDefault(section string, option string, def bool) (bool, error) {
+	sv, ok, err := c.lookup(section, option)
+	if !ok {
+		return def, err
+	}
+
+	value, ok := c.boolValue(sv)
+	if !ok {
+		return def, nil
+	}
+	return value, nil
+}
+
+// DurationDefault has the same behaviour as Duration but returns def when the
+// option does not exist or is not a duration.
+func (c *Config) DurationDefault(section string, option string, def time.Duration) (time.Duration, error) {
+	sv, ok, err := c.lookup(section, option)
+	if !ok {
+		return def, err
+	}
+
+	value, err := time.ParseDuration(sv)
+	if err != nil {
+		return def, nil
+	}
+	return value, nil
+}
+
+// FloatDefault has the same behaviour as Float but returns def when the option
+// does not exist or is not a float.
+func (c *Config) FloatDefault(section string, option string, def float64) (float64, error) {
+	sv, ok, err := c.lookup(section, option)
+	if !ok {
+		return def, err
+	}
+
+	value, err := strconv.ParseFloat(sv, 64)
+	if err != nil {
+		return def, nil
+	}
+	return value, nil
+}
+
+// IntDefault has the same behaviour as Int but returns def when the option
+// does not exist or is not an int.
+func (c *Config) IntDefault(section string, option string, def int) (int, error) {
+	sv, ok, err := c.lookup(section, option)
+	if !ok {
+		return def, err
+	}
+
+	value, err := c.atoi(sv)
+	if err != nil {
+		return def, nil
+	}
+	return value, nil
+}
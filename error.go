@@ -14,6 +14,8 @@
 
 package config
 
+import "reflect"
+
 type SectionError string
 
 func (e SectionError) Error() string {
@@ -25,3 +27,20 @@ type OptionError string
 func (e OptionError) Error() string {
 	return "option not found: " + string(e)
 }
+
+// FieldError records a failure to load an option into a struct field by
+// ParseConf.
+type FieldError struct {
+	Section string
+	Option  string
+	Kind    reflect.Kind // Kind of the field
+	Err     error
+}
+
+func (e *FieldError) Error() string {
+	return "could not load [" + e.Section + "] " + e.Option + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,144 @@
+// Copyright 2009  The "config" Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// splitList splits v on sep, which defaults to a comma when empty, and trims
+// the surrounding whitespace of each element. Empty elements, as left by a
+// trailing or doubled separator, are dropped.
+func splitList(v string, sep string) []string {
+	if sep == "" {
+		sep = ","
+	}
+
+	ss := strings.Split(v, sep)
+	list := ss[:0]
+	for _, s := range ss {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// StringSlice has the same behaviour as String but splits the response into a
+// list on sep, which defaults to a comma when empty. Each element has its
+// surrounding whitespace trimmed, and empty elements are dropped.
+func (c *Config) StringSlice(section string, option string, sep string) (value []string, err error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return nil, err
+	}
+
+	return splitList(sv, sep), nil
+}
+
+// FloatSlice has the same behaviour as StringSlice but converts each element
+// to float.
+func (c *Config) FloatSlice(section string, option string, sep string) (value []float64, err error) {
+	list, err := c.StringSlice(section, option, sep)
+	if err != nil {
+		return nil, err
+	}
+
+	value = make([]float64, len(list))
+	for i, s := range list {
+		if value[i], err = strconv.ParseFloat(s, 64); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// IntSlice has the same behaviour as StringSlice but converts each element to
+// int.
+func (c *Config) IntSlice(section string, option string, sep string) (value []int, err error) {
+	list, err := c.StringSlice(section, option, sep)
+	if err != nil {
+		return nil, err
+	}
+
+	value = make([]int, len(list))
+	for i, s := range list {
+		if value[i], err = c.atoi(s); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// StringSet has the same behaviour as StringSlice, with a comma separator, but
+// sorts the elements into two lists for toggles, e.g. "audit, !verbose": those
+// prefixed by "!" are disabled, with the prefix and the whitespace after it
+// stripped, the others are enabled. Both lists keep the input order.
+func (c *Config) StringSet(section string, option string) (enabled, disabled []string, err error) {
+	list, err := c.StringSlice(section, option, ",")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, s := range list {
+		if strings.HasPrefix(s, "!") {
+			if s = strings.TrimSpace(s[1:]); s != "" {
+				disabled = append(disabled, s)
+			}
+		} else {
+			enabled = append(enabled, s)
+		}
+	}
+	return enabled, disabled, nil
+}
+
+// splitPairs splits v into key/value pairs on pairSep, which defaults to a
+// comma when empty, and each pair on the first kvSep, which defaults to "=".
+// Keys and values have their surrounding whitespace trimmed, and empty pairs
+// are dropped as in splitList. A pair without kvSep, or with an empty key, is
+// an error.
+func splitPairs(v string, pairSep string, kvSep string) (map[string]string, error) {
+	if kvSep == "" {
+		kvSep = "="
+	}
+
+	list := splitList(v, pairSep)
+	pairs := make(map[string]string, len(list))
+	for _, s := range list {
+		key, value, ok := strings.Cut(s, kvSep)
+		if key = strings.TrimSpace(key); !ok || key == "" {
+			return nil, fmt.Errorf("malformed pair %q: expected key%svalue", s, kvSep)
+		}
+		pairs[key] = strings.TrimSpace(value)
+	}
+	return pairs, nil
+}
+
+// StringMap has the same behaviour as String but splits the response into a
+// map, e.g. "env=prod, team=core", on pairSep, which defaults to a comma when
+// empty, then each pair on the first kvSep, which defaults to "=". Keys and
+// values have their surrounding whitespace trimmed. It returns an error for a
+// pair without kvSep or with an empty key; a later pair overwrites an earlier
+// one with the same key.
+func (c *Config) StringMap(section string, option string, pairSep string, kvSep string) (map[string]string, error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return nil, err
+	}
+
+	return splitPairs(sv, pairSep, kvSep)
+}
@@ -0,0 +1,83 @@
+// Copyright 2009  The "config" Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// The getters below are for the options an application cannot start
+// without, read once at bootstrap: they panic, with a message naming the
+// section and the option, where the variant without "Must" returns an error.
+
+// mustPanic panics with the error of the getter for the option.
+func mustPanic(section string, option string, err error) {
+	panic(fmt.Sprintf("config: [%s] %s: %v", section, option, err))
+}
+
+// MustString has the same behaviour as String but panics on error.
+func (c *Config) MustString(section string, option string) string {
+	value, err := c.String(section, option)
+	if err != nil {
+		mustPanic(section, option, err)
+	}
+	return value
+}
+
+// MustBool has the same behaviour as Bool but panics on error.
+func (c *Config) MustBool(section string, option string) bool {
+	value, err := c.Bool(section, option)
+	if err != nil {
+		mustPanic(section, option, err)
+	}
+	return value
+}
+
+// MustInt has the same behaviour as Int but panics on error.
+func (c *Config) MustInt(section string, option string) int {
+	value, err := c.Int(section, option)
+	if err != nil {
+		mustPanic(section, option, err)
+	}
+	return value
+}
+
+// MustInt64 has the same behaviour as Int64 but panics on error.
+func (c *Config) MustInt64(section string, option string) int64 {
+	value, err := c.Int64(section, option)
+	if err != nil {
+		mustPanic(section, option, err)
+	}
+	return value
+}
+
+// MustFloat has the same behaviour as Float but panics on error.
+func (c *Config) MustFloat(section string, option string) float64 {
+	value, err := c.Float(section, option)
+	if err != nil {
+		mustPanic(section, option, err)
+	}
+	return value
+}
+
+// MustDuration has the same behaviour as Duration but panics on error.
+func (c *Config) MustDuration(section string, option string) time.Duration {
+	value, err := c.Duration(section, option)
+	if err != nil {
+		mustPanic(section, option, err)
+	}
+	return value
+}
@@ -14,7 +14,11 @@
 
 package config
 
-import "errors"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 // AddOption adds a new option and value to the configuration.
 //
@@ -24,24 +28,149 @@ import "errors"
 // It returns true if the option and value were inserted, and false if the value
 // was overwritten.
 func (c *Config) AddOption(section string, option string, value string) bool {
-	c.AddSection(section) // Make sure section exists
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.addSection(section) // Make sure section exists
 
 	if section == "" {
 		section = DEFAULT_SECTION
 	}
+	section, option = c.sectionKey(section), c.optionKey(option)
 
-	_, ok := c.data[section][option]
+	old, ok := c.data[section][option]
+	if ok && c.KeepComments {
+		c.data[section][option] = &tValue{position: old.position, v: value, comments: old.comments}
+		return false
+	}
 
-	c.data[section][option] = &tValue{c.lastIdOption[section], value}
+	c.data[section][option] = &tValue{position: c.lastIdOption[section], v: value}
 	c.lastIdOption[section]++
 
 	return !ok
 }
 
+// appendOption adds a value to the option, as read again in a file: like
+// AddOption, unless AccumulateRepeated is set and the option exists in the
+// section, in which case the value is added to the previous ones.
+func (c *Config) appendOption(section string, option string, value string) {
+	c.mu.Lock()
+	tValue, ok := c.data[c.sectionKey(section)][c.optionKey(option)]
+	if ok && c.AccumulateRepeated {
+		if tValue.vs == nil {
+			tValue.vs = []string{tValue.v}
+		}
+		tValue.vs = append(tValue.vs, value)
+		tValue.v = value
+	}
+	c.mu.Unlock()
+
+	if !ok || !c.AccumulateRepeated {
+		c.AddOption(section, option, value)
+	}
+}
+
+// setSource records where the option was read.
+func (c *Config) setSource(section string, option string, fname string, line int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if tValue, ok := c.data[c.sectionKey(section)][c.optionKey(option)]; ok {
+		tValue.file, tValue.line = fname, line
+	}
+}
+
+// OptionSource returns the file and the line where the option of the section
+// was read, for messages pointing at it. The file is empty if the option was
+// not read from a named file, e.g. by NewFromString. It returns false if the
+// option was not read at all, e.g. set by AddOption, or does not exist; the
+// default section is not searched.
+func (c *Config) OptionSource(section string, option string) (file string, line int, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if section == "" {
+		section = DEFAULT_SECTION
+	}
+	tValue, ok := c.data[c.sectionKey(section)][c.optionKey(option)]
+	if !ok || tValue.line == 0 {
+		return "", 0, false
+	}
+	return tValue.file, tValue.line, true
+}
+
+// continueOption adds a continuation line to the last value of the option.
+func (c *Config) continueOption(section string, option string, line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tValue, ok := c.data[c.sectionKey(section)][c.optionKey(option)]
+	if !ok {
+		return
+	}
+	tValue.v += "\n" + line
+	if n := len(tValue.vs); n > 0 {
+		tValue.vs[n-1] = tValue.v
+	}
+}
+
+// SetOption has the same behaviour as AddOption, but it returns an error
+// instead of storing an option whose name could not be read back from a file:
+// an empty name, one with spaces at either end, one which contains a
+// separator character or a line break, one which starts with "[", or one
+// with a comment character (see CommentChars) at the start, after a space or
+// a tab, or after a backslash.
+func (c *Config) SetOption(section string, option string, value string) error {
+	if option == "" || strings.TrimSpace(option) != option || strings.ContainsAny(option, "=:\r\n") ||
+		option[0] == '[' || c.hasComment(option) {
+		return fmt.Errorf("invalid option name %q", option)
+	}
+
+	c.AddOption(section, option, value)
+	return nil
+}
+
+// hasComment reports whether a comment character of c starts the name, or
+// follows a space, a tab or a backslash in it; the line holding such a name
+// would be cut there, or have the backslash taken as an escape, when read.
+func (c *Config) hasComment(name string) bool {
+	chars := c.commentChars()
+	for i := 0; i < len(name); i++ {
+		if strings.IndexByte(chars, name[i]) == -1 {
+			continue
+		}
+		if i == 0 || name[i-1] == ' ' || name[i-1] == '\t' || name[i-1] == '\\' {
+			return true
+		}
+	}
+	return false
+}
+
+// orderedOptions returns the options of the section in their input order.
+func (c *Config) orderedOptions(section string) []string {
+	options := make([]string, 0, len(c.data[section]))
+	for option := range c.data[section] {
+		options = append(options, option)
+	}
+	sort.Slice(options, func(i, j int) bool {
+		return c.data[section][options[i]].position < c.data[section][options[j]].position
+	})
+	return options
+}
+
 // RemoveOption removes a option and value from the configuration.
+// As in AddOption, an empty section means the default section.
 // It returns true if the option and value were removed, and false otherwise,
 // including if the section did not exist.
 func (c *Config) RemoveOption(section string, option string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if section == "" {
+		section = DEFAULT_SECTION
+	}
+	section, option = c.sectionKey(section), c.optionKey(option)
+
 	if _, ok := c.data[section]; !ok {
 		return false
 	}
@@ -53,11 +182,13 @@ func (c *Config) RemoveOption(section string, option string) bool {
 }
 
 // HasOption checks if the configuration has the given option in the section.
-// It returns false if either the option or section do not exist.
+// Like RawString, it also looks for the option in the default section, even
+// when the section does not exist; no unfolding is done.
 func (c *Config) HasOption(section string, option string) bool {
-	if _, ok := c.data[section]; !ok {
-		return false
-	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	section, option = c.sectionKey(section), c.optionKey(option)
 
 	_, okd := c.data[DEFAULT_SECTION][option]
 	_, oknd := c.data[section][option]
@@ -66,11 +197,16 @@ func (c *Config) HasOption(section string, option string) bool {
 }
 
 // Options returns the list of options available in the given section.
-// It returns an error if the section does not exist and an empty list if the
+// It returns a SectionError if the section does not exist and an empty list if the
 // section is empty. Options within the default section are also included.
+// The list is sorted.
 func (c *Config) Options(section string) (options []string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	section = c.sectionKey(section)
 	if _, ok := c.data[section]; !ok {
-		return nil, errors.New(SectionError(section).Error())
+		return nil, SectionError(section)
 	}
 
 	// Keep a map of option names we've seen to deduplicate.
@@ -90,16 +226,21 @@ func (c *Config) Options(section string) (options []string, err error) {
 		options[i] = k
 		i++
 	}
+	sort.Strings(options)
 
 	return options, nil
 }
 
 // SectionOptions returns only the list of options available in the given section.
 // Unlike Options, SectionOptions doesn't return options in default section.
-// It returns an error if the section doesn't exist.
+// It returns a SectionError if the section doesn't exist. The list is sorted.
 func (c *Config) SectionOptions(section string) (options []string, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	section = c.sectionKey(section)
 	if _, ok := c.data[section]; !ok {
-		return nil, errors.New(SectionError(section).Error())
+		return nil, SectionError(section)
 	}
 
 	options = make([]string, len(c.data[section]))
@@ -108,6 +249,71 @@ func (c *Config) SectionOptions(section string) (options []string, err error) {
 		options[i] = s
 		i++
 	}
+	sort.Strings(options)
 
 	return options, nil
 }
+
+// GetSectionAsMap returns the options of the section with their values, for a
+// block of configuration to be parsed elsewhere. With mergeDefault, the
+// options of the default section are included too, unless the section has
+// its own. The values are raw unless unfold is set, in which case they are
+// unfolded as by String.
+// It returns a SectionError if the section does not exist.
+func (c *Config) GetSectionAsMap(section string, mergeDefault bool, unfold bool) (map[string]string, error) {
+	var options []string
+	var err error
+	if mergeDefault {
+		options, err = c.Options(section)
+	} else {
+		options, err = c.SectionOptions(section)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string, len(options))
+	for _, option := range options {
+		var v string
+		if unfold {
+			v, err = c.String(section, option)
+		} else {
+			v, err = c.RawString(section, option)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[option] = v
+	}
+	return m, nil
+}
+
+// OptionsWithPrefix returns the options of the section whose name starts with
+// prefix, with their unfolded values, e.g. the "feature_" flags. With strip,
+// the prefix is removed from the names in the map. The options of the
+// default section are not included.
+// It returns a SectionError if the section does not exist.
+func (c *Config) OptionsWithPrefix(section string, prefix string, strip bool) (map[string]string, error) {
+	options, err := c.SectionOptions(section)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = c.optionKey(prefix)
+	m := make(map[string]string)
+	for _, option := range options {
+		if !strings.HasPrefix(option, prefix) {
+			continue
+		}
+		v, err := c.String(section, option)
+		if err != nil {
+			return nil, err
+		}
+		if strip {
+			m[strings.TrimPrefix(option, prefix)] = v
+		} else {
+			m[option] = v
+		}
+	}
+	return m, nil
+}
@@ -17,6 +17,9 @@ package config
 import (
 	"bufio"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"strings"
 	"unicode"
@@ -30,7 +33,8 @@ func _read(fname string, c *Config) (*Config, error) {
 		return nil, err
 	}
 
-	if err = c.read(bufio.NewReader(file)); err != nil {
+	if err = c.readFile(bufio.NewReader(file), fname); err != nil {
+		file.Close()
 		return nil, err
 	}
 
@@ -53,32 +57,139 @@ func ReadDefault(fname string) (*Config, error) {
 	return _read(fname, NewDefault())
 }
 
+// ReadWithOptions reads a configuration file and returns its representation.
+// All arguments, except `fname`, are related to `NewWithOptions()`
+func ReadWithOptions(fname string, caseInsensitive bool) (*Config, error) {
+	return _read(fname, NewWithOptions(caseInsensitive))
+}
+
+// ReadFiles reads the configuration files in order, as ReadDefault does, and
+// merges them so that the options of a file override those of the files
+// before it (see Merge). The error for a file which cannot be parsed names
+// the file.
+func ReadFiles(fnames ...string) (*Config, error) {
+	return readFiles(fnames, false)
+}
+
+// ReadOptionalFiles is like ReadFiles, but skips the files which do not
+// exist, e.g. a local override.
+func ReadOptionalFiles(fnames ...string) (*Config, error) {
+	return readFiles(fnames, true)
+}
+
+func readFiles(fnames []string, skipMissing bool) (*Config, error) {
+	c := NewDefault()
+	for _, fname := range fnames {
+		layer, err := ReadDefault(fname)
+		if err != nil {
+			if skipMissing && errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			// The errors of os.Open already name the file.
+			var pe *fs.PathError
+			if errors.As(err, &pe) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%s: %w", fname, err)
+		}
+		c.Merge(layer)
+	}
+	return c, nil
+}
+
+// ReadFrom reads a configuration from r, as ReadDefault does from a file.
+func ReadFrom(r io.Reader) (*Config, error) {
+	c := NewDefault()
+	if err := c.read(bufio.NewReader(r)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewFromString reads a configuration from data, e.g. defaults embedded
+// with go:embed. It uses values by default.
+func NewFromString(data string) (*Config, error) {
+	return ReadFrom(strings.NewReader(data))
+}
+
 // * * *
 
+// unquoteValue returns the value between double quotes, if v is quoted, with
+// the escapes \n, \t, \" and \\ replaced. A quoted value keeps its leading
+// and trailing spaces. Any other value is returned as is.
+func unquoteValue(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	v = v[1 : len(v)-1]
+
+	var buf strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			switch v[i+1] {
+			case 'n':
+				buf.WriteByte('\n')
+				i++
+				continue
+			case 't':
+				buf.WriteByte('\t')
+				i++
+				continue
+			case '"', '\\':
+				buf.WriteByte(v[i+1])
+				i++
+				continue
+			}
+		}
+		buf.WriteByte(v[i])
+	}
+	return buf.String()
+}
+
+// read parses the configuration from buf. A value may go on over several
+// lines in two ways: the lines after the option which start with whitespace
+// are appended to its value after a newline, and a line ending with a
+// backslash is joined to the next one, without the backslash and the
+// indentation of the next line. A line ending with two backslashes is not
+// joined and ends with a single one instead. (Before the joining, a value
+// could end with a backslash, e.g. "C:\tmp\"; the last backslash of such a
+// value has to be doubled now, or the value quoted.)
+//
+// A value between double quotes keeps its spaces; see unquoteValue.
 func (c *Config) read(buf *bufio.Reader) (err error) {
-	var section, option string
+	return c.readFile(buf, "")
+}
+
+// readFile is read for the named file, recorded as the source of the options
+// (see OptionSource).
+func (c *Config) readFile(buf *bufio.Reader, fname string) (err error) {
+	// The options before the first section header are in the default one.
+	var section, option = DEFAULT_SECTION, ""
 	var scanner = bufio.NewScanner(buf)
-	for scanner.Scan() {
-		l := strings.TrimRightFunc(stripComments(scanner.Text()), unicode.IsSpace)
+	var comments = c.commentChars()
+	var joined string // start of a line ended by a backslash
+	var kept []string // comments and blank lines, with KeepComments
+	var n, start int  // line numbers of the last line and of the joined one
 
+	parse := func(l string) error {
 		// Switch written for readability (not performance)
 		switch {
 		// Empty line and comments
-		case len(l) == 0, l[0] == '#', l[0] == ';':
-			continue
+		case len(l) == 0, strings.IndexByte(comments, l[0]) != -1:
+			return nil
 
 		// New section. The [ must be at the start of the line
 		case l[0] == '[' && l[len(l)-1] == ']':
 			option = "" // reset multi-line value
 			section = strings.TrimSpace(l[1 : len(l)-1])
 			c.AddSection(section)
+			c.keepComments(section, "", kept)
+			kept = nil
 
 		// Continuation of multi-line value
 		// starts with whitespace, we're in a section and working on an option
 		case section != "" && option != "" && (l[0] == ' ' || l[0] == '\t'):
-			prev, _ := c.RawString(section, option)
-			value := strings.TrimSpace(l)
-			c.AddOption(section, option, prev+"\n"+value)
+			c.continueOption(section, option, strings.TrimSpace(l))
 
 		// Other alternatives
 		default:
@@ -88,13 +199,80 @@ func (c *Config) read(buf *bufio.Reader) (err error) {
 			// Option and value
 			case i > 0 && l[0] != ' ' && l[0] != '\t': // found an =: and it's not a multiline continuation
 				option = strings.TrimSpace(l[0:i])
-				value := strings.TrimSpace(l[i+1:])
-				c.AddOption(section, option, value)
+				value := unquoteValue(strings.TrimSpace(l[i+1:]))
+				c.appendOption(section, option, value)
+				c.setSource(section, option, fname, start)
+				c.keepComments(section, option, kept)
+				kept = nil
 
 			default:
 				return errors.New("could not parse line: " + l)
 			}
 		}
+		return nil
+	}
+
+	for scanner.Scan() {
+		n++
+		if joined == "" {
+			start = n
+		}
+		l := strings.TrimRightFunc(stripComments(scanner.Text(), comments), unicode.IsSpace)
+		if c.KeepComments && joined == "" && (len(l) == 0 || strings.IndexByte(comments, l[0]) != -1) {
+			kept = append(kept, strings.TrimRightFunc(scanner.Text(), unicode.IsSpace))
+			continue
+		}
+		if joined != "" {
+			l = joined + strings.TrimLeftFunc(l, unicode.IsSpace)
+			joined = ""
+		}
+		switch {
+		case len(l) != 0 && strings.IndexByte(comments, l[0]) != -1:
+			// Comment lines are never joined.
+		case strings.HasSuffix(l, `\\`):
+			l = l[:len(l)-1]
+		case strings.HasSuffix(l, `\`):
+			joined = l[:len(l)-1]
+			continue
+		}
+		if err = parse(l); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	// A backslash on the last line joins nothing.
+	if err = parse(joined); err != nil {
+		return err
+	}
+	if c.KeepComments {
+		c.mu.Lock()
+		c.trailer = append([]string{}, kept...)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// keepComments attaches the lines read before the section header (if option
+// is empty) or the option, with KeepComments. A section read always gets its
+// lines, even none, so that writing does not add a blank line before it.
+func (c *Config) keepComments(section string, option string, lines []string) {
+	if !c.KeepComments {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	section = c.sectionKey(section)
+	if option == "" {
+		if c.sectionComments == nil {
+			c.sectionComments = make(map[string][]string)
+		}
+		c.sectionComments[section] = append([]string{}, lines...)
+		return
+	}
+	if tValue, ok := c.data[section][c.optionKey(option)]; ok && len(lines) > 0 {
+		tValue.comments = append(tValue.comments, lines...)
 	}
-	return scanner.Err()
 }
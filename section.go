@@ -14,6 +14,12 @@
 
 package config
 
+import (
+	"regexp"
+	"sort"
+	"time"
+)
+
 // AddSection adds a new section to the configuration.
 //
 // If the section is nil then uses the section by default which it's already
@@ -22,10 +28,18 @@ package config
 // It returns true if the new section was inserted, and false if the section
 // already existed.
 func (c *Config) AddSection(section string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.addSection(section)
+}
+
+func (c *Config) addSection(section string) bool {
 	// DEFAULT_SECTION
 	if section == "" {
 		return false
 	}
+	section = c.sectionKey(section)
 
 	if _, ok := c.data[section]; ok {
 		return false
@@ -43,6 +57,10 @@ func (c *Config) AddSection(section string) bool {
 // RemoveSection removes a section from the configuration.
 // It returns true if the section was removed, and false if section did not exist.
 func (c *Config) RemoveSection(section string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	section = c.sectionKey(section)
 	_, ok := c.data[section]
 
 	// Default section cannot be removed.
@@ -57,6 +75,7 @@ func (c *Config) RemoveSection(section string) bool {
 
 	delete(c.lastIdOption, section)
 	delete(c.idSection, section)
+	delete(c.sectionComments, section)
 
 	return true
 }
@@ -64,14 +83,48 @@ func (c *Config) RemoveSection(section string) bool {
 // HasSection checks if the configuration has the given section.
 // (The default section always exists.)
 func (c *Config) HasSection(section string) bool {
-	_, ok := c.data[section]
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.data[c.sectionKey(section)]
 
 	return ok
 }
 
-// Sections returns the list of sections in the configuration.
-// (The default section always exists).
+// Sections returns the list of sections in the configuration, in the order
+// they were added, so the result is deterministic for a given input.
+// (The default section always exists and comes first).
 func (c *Config) Sections() (sections []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.sections()
+}
+
+// SectionsMatching returns the sorted list of sections whose name matches the
+// regular expression pattern, e.g. `^plugin:` for the [plugin:name] sections.
+// It returns an error if the pattern does not compile.
+func (c *Config) SectionsMatching(pattern string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	sections := []string{}
+	for _, section := range c.sections() {
+		if re.MatchString(section) {
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+
+	return sections, nil
+}
+
+func (c *Config) sections() (sections []string) {
 	sections = make([]string, len(c.idSection))
 	pos := 0 // Position in sections
 
@@ -86,3 +139,70 @@ func (c *Config) Sections() (sections []string) {
 
 	return sections
 }
+
+// Section is a view of a section of a configuration, for code which reads
+// several options from it. Its methods have the same behaviour as those of
+// Config with the same name, for the bound section.
+type Section struct {
+	c    *Config
+	name string
+}
+
+// Section returns a view of the named section. The section does not need to
+// exist yet; lookups then fail as they would on the Config.
+func (c *Config) Section(name string) *Section {
+	return &Section{c: c, name: name}
+}
+
+// Name returns the name of the section.
+func (s *Section) Name() string {
+	return s.name
+}
+
+// HasOption checks if the section, or the default one, has the option; see
+// Config.HasOption.
+func (s *Section) HasOption(option string) bool {
+	return s.c.HasOption(s.name, option)
+}
+
+// Options returns the options of the section, without those of the default
+// one; see Config.SectionOptions.
+func (s *Section) Options() ([]string, error) {
+	return s.c.SectionOptions(s.name)
+}
+
+// RawString gets the raw value of the option; see Config.RawString.
+func (s *Section) RawString(option string) (string, error) {
+	return s.c.RawString(s.name, option)
+}
+
+// String gets the unfolded value of the option; see Config.String.
+func (s *Section) String(option string) (string, error) {
+	return s.c.String(s.name, option)
+}
+
+// Bool gets the value of the option as a bool; see Config.Bool.
+func (s *Section) Bool(option string) (bool, error) {
+	return s.c.Bool(s.name, option)
+}
+
+// Int gets the value of the option as an int; see Config.Int.
+func (s *Section) Int(option string) (int, error) {
+	return s.c.Int(s.name, option)
+}
+
+// Int64 gets the value of the option as an int64; see Config.Int64.
+func (s *Section) Int64(option string) (int64, error) {
+	return s.c.Int64(s.name, option)
+}
+
+// Float gets the value of the option as a float64; see Config.Float.
+func (s *Section) Float(option string) (float64, error) {
+	return s.c.Float(s.name, option)
+}
+
+// Duration gets the value of the option as a time.Duration; see
+// Config.Duration.
+func (s *Section) Duration(option string) (time.Duration, error) {
+	return s.c.Duration(s.name, option)
+}
@@ -15,57 +15,120 @@
 package config
 
 import (
+	"encoding"
 	"errors"
 	"fmt"
-	"os"
+	"image/color"
+	"math"
+	"net"
+	"net/url"
+	"path"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
-// Substitutes values, calculated by callback, on matching regex
-func (c *Config) computeVar(beforeValue *string, regx *regexp.Regexp, headsz, tailsz int, withVar func(*string) string) (*string, error) {
-	var i int
-	computedVal := beforeValue
-	for i = 0; i < _DEPTH_VALUES; i++ { // keep a sane depth
+// computeVar substitutes every match of regx in value by the value that
+// withVar returns for the variable name, which is the first subexpression.
+// A match without that subexpression is an escaped sigil, and it is replaced
+// by itself without its first character.
+func (c *Config) computeVar(value string, regx *regexp.Regexp, withVar func(name string) (string, error)) (string, error) {
+	var buf strings.Builder
+	last := 0
 
-		vr := regx.FindStringSubmatchIndex(*computedVal)
-		if len(vr) == 0 {
-			break
+	for _, m := range regx.FindAllStringSubmatchIndex(value, -1) {
+		buf.WriteString(value[last:m[0]])
+		last = m[1]
+
+		if m[2] < 0 {
+			buf.WriteString(value[m[0]+1 : m[1]])
+			continue
+		}
+		varVal, err := withVar(value[m[2]:m[3]])
+		if err != nil {
+			return "", err
 		}
+		buf.WriteString(varVal)
+	}
+	if last == 0 {
+		return value, nil
+	}
+	buf.WriteString(value[last:])
+
+	return buf.String(), nil
+}
 
-		varname := (*computedVal)[vr[headsz]:vr[headsz+1]]
-		varVal := withVar(&varname)
-		if varVal == "" {
-			return &varVal, errors.New(fmt.Sprintf("Option not found: %s", varname))
+// varRef is an option being unfolded.
+type varRef struct {
+	section, option string
+}
+
+// unfold substitutes the %(variable)s references in value, looking them up in
+// the section and in the default section, and unfolds their values in turn.
+// A reference qualified by a section, %(section:variable)s, is looked up in
+// that section instead (and in the default one), and the references in its
+// value are looked up there in turn. The chain holds the options being
+// unfolded, outermost first, so that a reference back to any of them is
+// reported as a cycle.
+func (c *Config) unfold(section string, value string, chain []varRef) (string, error) {
+	return c.computeVar(value, varRegExp, func(name string) (string, error) {
+		ref := varRef{section, name}
+		if sec, opt, ok := strings.Cut(name, ":"); ok {
+			ref = varRef{c.sectionKey(sec), opt}
+		}
+		ref.option = c.optionKey(ref.option)
+		for i, r := range chain {
+			if r == ref {
+				return "", fmt.Errorf("cycle detected while unfolding variables: %s -> %s",
+					formatChain(chain[i:], chain[0].section), ref.name(chain[0].section))
+			}
+		}
+		if depth := c.maxUnfoldDepth(); len(chain) > depth {
+			return "", fmt.Errorf("Possible cycle while unfolding variables: max depth of %d reached", depth)
 		}
 
-		// substitute by new value and take off leading '%(' and trailing ')s'
-		//  %(foo)s => headsz=2, tailsz=2
-		//  ${foo}  => headsz=2, tailsz=1
-		newVal := (*computedVal)[0:vr[headsz]-headsz] + varVal + (*computedVal)[vr[headsz+1]+tailsz:]
-		computedVal = &newVal
-	}
+		// search variable in current section as well as default section; an
+		// empty value is a value, so it shadows the default one
+		varVal, err := c.rawString(ref.section, ref.option)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Option not found: %s", name))
+		}
 
-	if i == _DEPTH_VALUES {
-		retVal := ""
-		return &retVal,
-			fmt.Errorf("Possible cycle while unfolding variables: max depth of %d reached", _DEPTH_VALUES)
+		return c.unfold(ref.section, varVal, append(chain[:len(chain):len(chain)], ref))
+	})
+}
+
+// name returns the option as it is referenced from the section.
+func (r varRef) name(section string) string {
+	if r.section == section {
+		return r.option
 	}
+	return r.section + ":" + r.option
+}
 
-	return computedVal, nil
+// formatChain joins the options of the chain as they are referenced from the
+// section, e.g. "a -> other:b".
+func formatChain(chain []varRef, section string) string {
+	names := make([]string, len(chain))
+	for i, r := range chain {
+		names[i] = r.name(section)
+	}
+	return strings.Join(names, " -> ")
 }
 
 // Bool has the same behaviour as String but converts the response to bool.
-// See "boolString" for string values converted to bool.
+// See "boolString" for string values converted to bool, and RegisterBoolValues.
 func (c *Config) Bool(section string, option string) (value bool, err error) {
 	sv, err := c.String(section, option)
 	if err != nil {
 		return false, err
 	}
 
-	value, ok := boolString[strings.ToLower(sv)]
+	value, ok := c.boolValue(sv)
 	if !ok {
 		return false, errors.New("could not parse bool value: " + sv)
 	}
@@ -73,6 +136,27 @@ func (c *Config) Bool(section string, option string) (value bool, err error) {
 	return value, nil
 }
 
+// BoolStrict has the same behaviour as Bool, but it only accepts the strings
+// in StrictBoolValues, by default "true" and "false" in any case, so that
+// e.g. "1" or "yes" are errors. It is meant for options which could be taken
+// for a number.
+func (c *Config) BoolStrict(section string, option string) (value bool, err error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return false, err
+	}
+
+	values := c.StrictBoolValues
+	if values == nil {
+		values = strictBoolString
+	}
+	value, ok := values[strings.ToLower(sv)]
+	if !ok {
+		return false, errors.New("could not parse strict bool value: " + sv)
+	}
+	return value, nil
+}
+
 // Float has the same behaviour as String but converts the response to float.
 func (c *Config) Float(section string, option string) (value float64, err error) {
 	sv, err := c.String(section, option)
@@ -83,11 +167,260 @@ func (c *Config) Float(section string, option string) (value float64, err error)
 	return value, err
 }
 
+// Float32 has the same behaviour as String but converts the response to
+// float32. It returns an error if the value is out of the range of float32.
+func (c *Config) Float32(section string, option string) (value float32, err error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := strconv.ParseFloat(sv, 32)
+	if err != nil {
+		return 0, err
+	}
+	return float32(f), nil
+}
+
+// Percent has the same behaviour as String but converts a percentage such as
+// "75%" to a fraction, 0.75; a value without "%" is taken as a fraction
+// already. With hundred, the result is scaled to 0-100 instead (75). With
+// strict, it returns an error if the fraction is not between 0 and 1.
+func (c *Config) Percent(section string, option string, hundred bool, strict bool) (value float64, err error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return 0, err
+	}
+
+	num, isPercent := strings.CutSuffix(sv, "%")
+	value, err = strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse percent value: %w", err)
+	}
+	if isPercent {
+		value /= 100
+	}
+	if strict && (value < 0 || value > 1) {
+		return 0, fmt.Errorf("percent value %s out of range 0%%-100%%", sv)
+	}
+	if hundred {
+		value *= 100
+	}
+	return value, nil
+}
+
+// IP has the same behaviour as String but converts the response to an IPv4
+// or IPv6 address, e.g. "0.0.0.0" or "::1".
+func (c *Config) IP(section string, option string) (net.IP, error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(sv)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q in [%s] %s", sv, section, option)
+	}
+	return ip, nil
+}
+
+// IPNet has the same behaviour as String but converts the response to an IP
+// network in CIDR notation, e.g. "10.0.0.0/8".
+func (c *Config) IPNet(section string, option string) (*net.IPNet, error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ipNet, err := net.ParseCIDR(sv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR network %q in [%s] %s", sv, section, option)
+	}
+	return ipNet, nil
+}
+
+// URL has the same behaviour as String but parses the response as a URL. If
+// scheme is not empty, the URL must have that scheme, so relative URLs are
+// rejected too.
+func (c *Config) URL(section string, option string, scheme string) (*url.URL, error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseURL(sv, scheme)
+}
+
+// parseURL parses v as a URL with the given scheme, if not empty.
+func parseURL(v string, scheme string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != "" && !strings.EqualFold(u.Scheme, scheme) {
+		return nil, fmt.Errorf("URL %q does not have scheme %q", v, scheme)
+	}
+	return u, nil
+}
+
+// Color has the same behaviour as String but parses the response as a color in
+// hexadecimal, "#RGB", "#RRGGBB" or "#RRGGBBAA". The alpha is opaque if left
+// out, and the components are kept as written, not premultiplied. In a file,
+// the value has to be quoted unless CommentChars leaves out "#"; an empty
+// value, as left by an unquoted color, is reported as such.
+func (c *Config) Color(section string, option string) (color.RGBA, error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+
+	return parseColor(sv)
+}
+
+// parseColor parses v as described in Color.
+func parseColor(v string) (color.RGBA, error) {
+	if v == "" {
+		return color.RGBA{}, errors.New(`invalid color "": empty, a color in a file must be quoted, as in "#RRGGBB"`)
+	}
+	h, ok := strings.CutPrefix(v, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	if len(h) == 6 {
+		h += "ff"
+	}
+	n, err := strconv.ParseUint(h, 16, 32)
+	if !ok || len(h) != 8 || err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q: expected #RGB, #RRGGBB or #RRGGBBAA in hexadecimal", v)
+	}
+	return color.RGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, nil
+}
+
+// Enum has the same behaviour as String but returns an error listing the
+// allowed values if the response is not one of them. With ignoreCase, the
+// comparison is case-insensitive.
+func (c *Config) Enum(section string, option string, allowed []string, ignoreCase bool) (string, error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return "", err
+	}
+
+	if err = oneOf(sv, allowed, ignoreCase); err != nil {
+		return "", err
+	}
+	return sv, nil
+}
+
+// oneOf returns an error if v is not in allowed.
+func oneOf(v string, allowed []string, ignoreCase bool) error {
+	for _, a := range allowed {
+		if v == a || ignoreCase && strings.EqualFold(v, a) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %q: expected one of %s", v, strings.Join(allowed, ", "))
+}
+
+// Complex128 has the same behaviour as String but converts the response to
+// complex128, written as in "1.5+2.3i", "2i" or "-3".
+func (c *Config) Complex128(section string, option string) (value complex128, err error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err = strconv.ParseComplex(sv, 128)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse complex value: %w", err)
+	}
+	return value, nil
+}
+
+// Duration has the same behaviour as String but converts the response to
+// time.Duration, using the format accepted by time.ParseDuration (e.g. "1m30s").
+func (c *Config) Duration(section string, option string) (value time.Duration, err error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err = time.ParseDuration(sv)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse duration value: %w", err)
+	}
+
+	return value, nil
+}
+
+// Bytes has the same behaviour as String but converts a byte size such as
+// "10MB" or "512KiB" to a number of bytes. See parseBytes for the units.
+func (c *Config) Bytes(section string, option string) (value int64, err error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return 0, err
+	}
+
+	return parseBytes(sv)
+}
+
+// DurationPositive has the same behaviour as Duration but returns an error if
+// the duration is not positive, for options such as timeouts. Duration
+// accepts negative durations, e.g. "-5m" for a clock offset.
+func (c *Config) DurationPositive(section string, option string) (value time.Duration, err error) {
+	value, err = c.Duration(section, option)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("duration %s is not positive", value)
+	}
+	return value, nil
+}
+
+// Get has the same behaviour as String but infers the type of the response,
+// trying in order:
+//
+// bool: if the value is one of the strings in "boolString" (so "1" and "0"
+// are returned as bool, not int; NumericBools does not apply, so other
+// numbers stay numbers)
+// int64: if Int64 would succeed
+// float64: if strconv.ParseFloat succeeds
+// string: otherwise
+func (c *Config) Get(section string, option string) (value interface{}, err error) {
+	sv, err := c.String(section, option)
+	if err != nil {
+		return nil, err
+	}
+
+	if b, ok := c.boolStringValue(sv); ok {
+		return b, nil
+	}
+	if i, err := c.parseInt(sv, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(sv, 64); err == nil {
+		return f, nil
+	}
+	return sv, nil
+}
+
 // Int has the same behaviour as String but converts the response to int.
+// The range is that of the platform's int, so use Int64 for values that may
+// not fit in 32 bits. See parseInt for the accepted syntax, e.g. "0xFF".
 func (c *Config) Int(section string, option string) (value int, err error) {
 	sv, err := c.String(section, option)
 	if err == nil {
-		value, err = strconv.Atoi(sv)
+		value, err = c.atoi(sv)
+	}
+
+	return value, err
+}
+
+// Int64 has the same behaviour as String but converts the response to int64.
+func (c *Config) Int64(section string, option string) (value int64, err error) {
+	sv, err := c.String(section, option)
+	if err == nil {
+		value, err = c.parseInt(sv, 64)
 	}
 
 	return value, err
@@ -95,16 +428,34 @@ func (c *Config) Int(section string, option string) (value int, err error) {
 
 // RawString gets the (raw) string value for the given option in the section.
 // The raw string value is not subjected to unfolding, which was illustrated in
-// the beginning of this documentation.
+// the beginning of this documentation. If EnvPrefix is set, the environment
+// variable for the option takes precedence over the configuration.
 //
-// It returns an error if either the section or the option do not exist.
+// It returns a SectionError if the section does not exist and the option is
+// not in the default section either, and an OptionError if only the option
+// does not exist.
 func (c *Config) RawString(section string, option string) (value string, err error) {
-	if _, ok := c.data[section]; ok {
-		if tValue, ok := c.data[section][option]; ok {
-			return tValue.v, nil
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.rawString(section, option)
+}
+
+func (c *Config) rawString(section string, option string) (value string, err error) {
+	section, option = c.sectionKey(section), c.optionKey(option)
+	if v, ok := c.envOption(section, option); ok {
+		return v, nil
+	}
+	if _, ok := c.data[section]; !ok {
+		if value, err = c.rawStringDefault(option); err != nil {
+			return "", SectionError(section)
 		}
+		return value, nil
+	}
+	if tValue, ok := c.data[section][option]; ok {
+		return tValue.v, nil
 	}
-	return c.RawStringDefault(option)
+	return c.rawStringDefault(option)
 }
 
 // RawStringDefault gets the (raw) string value for the given option from the
@@ -112,7 +463,17 @@ func (c *Config) RawString(section string, option string) (value string, err err
 //
 // It returns an error if the option does not exist in the DEFAULT section.
 func (c *Config) RawStringDefault(option string) (value string, err error) {
-	if tValue, ok := c.data[DEFAULT_SECTION][option]; ok {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.rawStringDefault(option)
+}
+
+func (c *Config) rawStringDefault(option string) (value string, err error) {
+	if v, ok := c.envOption(DEFAULT_SECTION, option); ok {
+		return v, nil
+	}
+	if tValue, ok := c.data[DEFAULT_SECTION][c.optionKey(option)]; ok {
 		return tValue.v, nil
 	}
 	return "", OptionError(option)
@@ -121,172 +482,835 @@ func (c *Config) RawStringDefault(option string) (value string, err error) {
 // String gets the string value for the given option in the section.
 // If the value needs to be unfolded (see e.g. %(host)s example in the beginning
 // of this documentation), then String does this unfolding automatically, up to
-// _DEPTH_VALUES number of iterations.
+// MaxUnfoldDepth levels of nested references. A reference to an option of
+// another section names it first, as in %(db:host)s. Environment variables given as
+// ${VAR} are substituted too, unless DisableEnvSubstitution is set, and
+// ${VAR:-default} falls back to the default when VAR is unset or empty.
 //
-// It returns an error if either the section or the option do not exist, or the
-// unfolding cycled.
+// It returns an error if either the section or the option do not exist, the
+// unfolding cycled, or an environment variable without a default is unset.
 func (c *Config) String(section string, option string) (value string, err error) {
-	value, err = c.RawString(section, option)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	value, err = c.rawString(section, option)
 	if err != nil {
 		return "", err
 	}
+	return c.expand(section, option, value)
+}
 
-	// % variables
-	computedVal, err := c.computeVar(&value, varRegExp, 2, 2, func(varName *string) string {
-		lowerVar := *varName
-		// search variable in default section as well as current section
-		varVal, _ := c.data[DEFAULT_SECTION][lowerVar]
-		if _, ok := c.data[section][lowerVar]; ok {
-			varVal = c.data[section][lowerVar]
-		}
-		return varVal.v
-	})
-	value = *computedVal
+// Values has the same behaviour as String, but it returns all the values of
+// an option repeated in a file read with AccumulateRepeated, in order. An
+// option which is not repeated has a single value.
+func (c *Config) Values(section string, option string) ([]string, error) {
+	return c.values(section, option, true)
+}
+
+// values returns the values of the option, unfolded if unfold is set.
+func (c *Config) values(section string, option string, unfold bool) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
+	value, err := c.rawString(section, option)
 	if err != nil {
+		return nil, err
+	}
+	values := []string{value}
+	if _, ok := c.envOption(c.sectionKey(section), c.optionKey(option)); !ok {
+		if tValue, ok := c.data[c.sectionKey(section)][c.optionKey(option)]; ok && tValue.vs != nil {
+			values = append([]string(nil), tValue.vs...)
+		}
+	}
+
+	if !unfold {
+		return values, nil
+	}
+	for i := range values {
+		if values[i], err = c.expand(section, option, values[i]); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// expand unfolds the variables and then the environment variables in the
+// value of the option.
+func (c *Config) expand(section string, option string, value string) (string, error) {
+	section = c.sectionKey(section)
+
+	// % variables
+	value, err := c.unfold(section, value, []varRef{{section, c.optionKey(option)}})
+	if err != nil || c.DisableEnvSubstitution {
 		return value, err
 	}
 
-	// $ environment variables
-	computedVal, err = c.computeVar(&value, envVarRegExp, 2, 1, func(varName *string) string {
-		return os.Getenv(*varName)
+	// $ environment variables, with the default after ":-" used when the
+	// variable is unset or empty
+	return c.computeVar(value, envVarRegExp, func(name string) (string, error) {
+		name, def, hasDef := strings.Cut(name, ":-")
+		if v, _ := c.lookupEnv(name); v != "" {
+			return v, nil
+		}
+		if hasDef {
+			return def, nil
+		}
+		return "", errors.New(fmt.Sprintf("Option not found: %s", name))
 	})
-	value = *computedVal
-	return value, err
+}
+
+// Resolved returns the value of every option of every section, the default
+// one included, as String returns it, by section and option name. The
+// options which cannot be unfolded are left out, and their errors are
+// returned joined.
+func (c *Config) Resolved() (map[string]map[string]string, error) {
+	var errs []error
+	m := make(map[string]map[string]string)
+	for _, section := range c.Sections() {
+		options, err := c.SectionOptions(section)
+		if err != nil {
+			continue // removed meanwhile
+		}
+		m[section] = make(map[string]string, len(options))
+		for _, option := range options {
+			v, err := c.String(section, option)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("[%s] %s: %w", section, option, err))
+				continue
+			}
+			m[section][option] = v
+		}
+	}
+	return m, errors.Join(errs...)
+}
+
+// ValidateEnv returns the sorted names of the environment variables which are
+// referenced as ${VAR} in the raw value of any option but are unset or empty,
+// so that String would fail on them; all of them, unlike String which stops
+// at the first. The references with a default (${VAR:-default}) never fail
+// and are left out. It returns nil if all the variables are set, or with
+// DisableEnvSubstitution.
+func (c *Config) ValidateEnv() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.DisableEnvSubstitution {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var missing []string
+	check := func(v string) {
+		for _, m := range envVarRegExp.FindAllStringSubmatch(v, -1) {
+			name := m[1]
+			if name == "" || strings.Contains(name, ":-") || seen[name] {
+				continue // $$ or a default
+			}
+			seen[name] = true
+			if v, _ := c.lookupEnv(name); v == "" {
+				missing = append(missing, name)
+			}
+		}
+	}
+	for _, options := range c.data {
+		for _, tValue := range options {
+			check(tValue.v)
+			for _, v := range tValue.vs {
+				check(v)
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Lookup has the same behaviour as String for an option given by a path such
+// as "db.host", split at the last dot into section and option. A path without
+// a dot names an option of the default section.
+func (c *Config) Lookup(path string) (string, error) {
+	section, option := DEFAULT_SECTION, path
+	if i := strings.LastIndexByte(path, '.'); i >= 0 {
+		section, option = path[:i], path[i+1:]
+	}
+	return c.String(section, option)
 }
 
 var ErrNotFound = errors.New("not found")
 var ErrUnsupportedType = errors.New("unsupported type")
 
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+	ipNetType    = reflect.TypeOf(net.IPNet{})
+	urlType      = reflect.TypeOf(url.URL{})
+	colorType    = reflect.TypeOf(color.RGBA{})
+
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	defaulterType       = reflect.TypeOf((*Defaulter)(nil)).Elem()
+)
+
+// Validator is implemented by the configuration types which check their
+// values as a whole, e.g. that a start precedes an end.
+type Validator interface {
+	Validate() error
+}
+
+// Defaulter is implemented by the configuration types which set their default
+// values in code. Defaults is called before the fields are loaded, so the
+// options present override the defaults and the missing ones keep them. It
+// is called for the elements of a slice filled from several sections too.
+type Defaulter interface {
+	Defaults()
+}
+
+// ParseConf loads the tagged fields of the struct st points to. If st
+// implements Validator, Validate is called once all the fields have been
+// loaded without error, and its error is returned; not if it is promoted
+// from an embedded pointer left nil, see loadFieldStructPtr.
 func (c *Config) ParseConf(st interface{}) error {
+	return c.parseConf(st, "", false)
+}
+
+// ParseConfStrict is like ParseConf, but it also returns an error listing the
+// options of the configuration which no field asked for, usually typos. The
+// options of the default section are not checked, since they are often only
+// there to be referenced by other values.
+func (c *Config) ParseConfStrict(st interface{}) error {
+	return c.parseConf(st, "", true)
+}
+
+// ParseConfSection is like ParseConf, but the exported fields without a
+// "config" tag are loaded too, from the option of the section named after
+// the field in snake case: field MaxConns is read from option "max_conns"
+// and DBHost from "db_host" (see snakeCase). The tags ":option" also refer to
+// the section, and so do the names given by the FallbackTag tags, such as
+// `json:"host"`, instead of the field names.
+func (c *Config) ParseConfSection(st interface{}, section string) error {
+	return c.parseConf(st, section, false)
+}
+
+// parseConf loads st as described by ParseConf; a section is given by
+// ParseConfSection.
+func (c *Config) parseConf(st interface{}, section string, strict bool) error {
 	v := reflect.ValueOf(st)
 	k := v.Kind()
 
 	if k != reflect.Ptr && k != reflect.Interface {
-		return ErrUnsupportedType
+		return fmt.Errorf("%w %T: pass a pointer to a struct", ErrUnsupportedType, st)
 	} else if v.IsNil() {
-		return ErrUnsupportedType
+		return fmt.Errorf("%w: nil %T", ErrUnsupportedType, st)
 	}
-	fmt.Printf("%v\n", k)
 	e := v.Elem()
 
 	switch e.Kind() {
 	case reflect.Struct:
-		return c.loadStruct(e)
+		// With AtomicParseConf, a copy is loaded and only stored on
+		// success. Loading sets new maps, slices and pointers rather than
+		// changing those the fields hold, so a shallow copy does.
+		target := v
+		if c.AtomicParseConf {
+			target = reflect.New(e.Type())
+			target.Elem().Set(e)
+		}
+
+		used := usedKeys{}
+		if err := c.loadStruct(target.Elem(), section, section != "", used); err != nil {
+			return err
+		}
+		if strict {
+			if err := c.checkUnused(used); err != nil {
+				return err
+			}
+		}
+		// A Validate promoted from an optional block left nil is not called.
+		if val, ok := target.Interface().(Validator); ok && !nilPromoted(target.Elem(), "Validate") {
+			if err := val.Validate(); err != nil {
+				return err
+			}
+		}
+		if c.AtomicParseConf {
+			e.Set(target.Elem())
+		}
+		return nil
 
 	case reflect.Interface, reflect.Ptr:
-		return c.ParseConf(e)
+		return c.parseConf(e.Interface(), section, strict)
 	default:
 		return ErrUnsupportedType
 	}
 }
-func (c *Config) loadStruct(v reflect.Value) error {
-	fmt.Printf("loadStruct\n")
+
+// loadStruct loads the tagged fields of v. The section is used for the tags
+// which leave it out (":option"), as in the elements of a slice filled from
+// several sections; it is empty at the top level.
+//
+// It loads every field even after a failure, and returns all the errors
+// joined, or nil if there were none. The options the fields ask for are
+// recorded in used. With byName, the untagged fields are loaded from the
+// option of the section named after them, as explained in ParseConfSection.
+//
+// Defaults is not called if it is promoted through a nil embedded pointer
+// (see nilPromoted); loadFieldStructPtr calls it on the struct it allocates.
+// Otherwise it is called first if v is a Defaulter, but then not for the embedded
+// structs: their method, if promoted, is the one already called, and
+// otherwise it is shadowed by the one of v. If v is not a Defaulter, e.g.
+// because two embedded structs have the method, those are called.
+func (c *Config) loadStruct(v reflect.Value, section string, byName bool, used usedKeys) error {
+	if v.CanAddr() && v.Addr().CanInterface() && !nilPromoted(v, "Defaults") {
+		if d, ok := v.Addr().Interface().(Defaulter); ok {
+			d.Defaults()
+		}
+	}
+	return c.loadFields(v, section, byName, used)
+}
+
+// loadFields loads the fields of v as described in loadStruct, without
+// calling Defaults.
+func (c *Config) loadFields(v reflect.Value, section string, byName bool, used usedKeys) error {
+	var errs []error
 	t := v.Type()
 	n := t.NumField()
 	for i := 0; i < n; i++ {
-		sec, opt := fieldName(t.Field(i))
+		sf := t.Field(i)
+		// The fields of an embedded struct are loaded as if they were
+		// declared here, and so are those of an embedded pointer to an
+		// exported struct, if any is present; other embedded types are
+		// skipped.
+		if sf.Anonymous && sf.Tag.Get("config") != "-" {
+			var err error
+			if f := v.Field(i); f.Kind() == reflect.Struct && reflect.PtrTo(t).Implements(defaulterType) {
+				err = c.loadFields(f, section, byName, used)
+			} else if f.Kind() == reflect.Struct {
+				err = c.loadStruct(f, section, byName, used)
+			} else if c.isStructPtr(f.Type()) && f.CanSet() {
+				err = c.loadFieldStructPtr(f, section, byName, used)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		sec, opt := fieldName(sf)
+		if _, tagged := sf.Tag.Lookup("config"); !tagged && !sf.Anonymous && sf.IsExported() {
+			if byName {
+				opt = snakeCase(sf.Name)
+			}
+			if name, ok := sf.Tag.Lookup(c.FallbackTag); ok && c.FallbackTag != "" && section != "" {
+				// As in encoding/json: "-" skips the field and an
+				// empty name keeps the default one.
+				if name, _, _ = strings.Cut(name, ","); name == "-" {
+					opt = ""
+				} else if name != "" {
+					opt = name
+				}
+			}
+		}
 
 		if sec == "" {
-			continue
+			if opt == "" {
+				continue
+			}
+			if section == "" {
+				errs = append(errs, fmt.Errorf("malformed config tag %q on field %s: no section",
+					sf.Tag.Get("config"), sf.Name))
+				continue
+			}
+			sec = section
 		}
 		f := v.Field(i)
-		err := c.loadSecOpt(f, sec, opt)
-		if err != nil && err != ErrNotFound {
-			return err
+		// Only a map, a slice of structs or a pointer to a struct is
+		// filled from whole sections; anything else needs both halves of
+		// the tag.
+		if opt == "" && f.Kind() != reflect.Map && !isStructSlice(f.Type()) && !c.isStructPtr(f.Type()) {
+			errs = append(errs, fmt.Errorf("malformed config tag %q on field %s: expected \"section:option\"",
+				sf.Tag.Get("config"), sf.Name))
+			continue
+		}
+		// The sections filling a slice of structs or a pointer to a
+		// struct are recorded option by option, as each field is loaded.
+		if opt != "" || !isStructSlice(f.Type()) && !c.isStructPtr(f.Type()) {
+			used.add(c.sectionKey(sec), c.optionKey(opt))
+		}
+		if aliases, ok := sf.Tag.Lookup("alias"); ok && opt != "" {
+			var err error
+			if opt, err = c.pickAlias(sec, opt, aliases, used); err != nil {
+				errs = append(errs, fmt.Errorf("malformed alias tag %q on field %s: %w", aliases, sf.Name, err))
+				continue
+			}
+		}
+		// Setting an unexported field would panic.
+		if !f.CanSet() {
+			if !sf.IsExported() {
+				errs = append(errs, fmt.Errorf("field %s is not settable: it is not exported", sf.Name))
+			} else {
+				errs = append(errs, fmt.Errorf("field %s is not settable; pass a pointer", sf.Name))
+			}
+			continue
+		}
+		err := c.loadSecOpt(f, sec, opt, sf.Tag, used)
+		if err != nil && !isNotFound(err) {
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func (c *Config) loadSecOpt(f reflect.Value, sec string, opt string) error {
+func (c *Config) loadSecOpt(f reflect.Value, sec string, opt string, tag reflect.StructTag, used usedKeys) error {
+	if opt == "" && isStructSlice(f.Type()) {
+		return c.loadFieldSections(f, sec, used)
+	}
+	if opt == "" && c.isStructPtr(f.Type()) {
+		return c.loadFieldStructPtr(f, sec, false, used)
+	}
+	if f.Kind() == reflect.Map && opt == "" {
+		err := c.loadFieldMap(f, sec)
+		if err == ErrNotFound && tag.Get("required") == "true" {
+			return fmt.Errorf("required section [%s] is missing", sec)
+		}
+		return err
+	}
 
-	switch f.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return c.loadFieldInt(f, sec, opt)
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		return c.loadFieldUint(f, sec, opt)
-	//case reflect.Float32, reflect.Float64:
-	//	return c.loadFieldFloat(f, name)
-	case reflect.String:
-		return c.loadFieldString(f, sec, opt)
-	case reflect.Bool:
-		return c.loadFieldBool(f, sec, opt)
-	case reflect.Slice:
-		return c.loadFieldSlice(f, sec, opt)
-	case reflect.Map:
-		return c.loadFieldMap(f, sec, opt)
-	default:
-		return errors.New(fmt.Sprintf("unsupported type:[%s-%s]: %s", sec, opt, f.Kind()))
+	err := c.loadOption(f, sec, opt, tag)
+	if err == nil || isNotFound(err) {
+		return err
 	}
+	return &FieldError{Section: sec, Option: opt, Kind: f.Kind(), Err: err}
 }
-func (c *Config) loadFieldInt(f reflect.Value, sec string, opt string) error {
 
-	i, err := c.Int(sec, opt)
+// loadOption sets f from the value of the option, or from the "default" tag
+// if the option does not exist.
+func (c *Config) loadOption(f reflect.Value, sec string, opt string, tag reflect.StructTag) error {
+	// With raw:"true" the value is taken as is, without unfolding.
+	raw := tag.Get("raw") == "true"
+
+	// The values of a repeated option are the elements of a slice.
+	if f.Kind() == reflect.Slice && f.Type().Elem().Kind() != reflect.Uint8 {
+		vs, err := c.values(sec, opt, !raw)
+		if err == nil && len(vs) > 1 {
+			if err = checkOneOf(f, vs, false, tag); err != nil {
+				return err
+			}
+			return c.loadFieldList(f, vs)
+		}
+	}
+
+	var v string
+	var err error
+	if raw {
+		v, err = c.RawString(sec, opt)
+	} else {
+		v, err = c.String(sec, opt)
+	}
+	if isNotFound(err) {
+		def, ok := tag.Lookup("default")
+		if !ok {
+			if tag.Get("required") == "true" {
+				return errors.New("required option is missing")
+			}
+			return err
+		}
+		if err = checkOneOf(f, []string{def}, true, tag); err == nil {
+			err = c.loadFieldValue(f, def, tag)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid default %q: %w", def, err)
+		}
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	f.SetInt(int64(i))
+	if err = checkOneOf(f, []string{v}, true, tag); err != nil {
+		return err
+	}
+
+	err = c.loadFieldValue(f, v, tag)
+	if err == ErrUnsupportedType {
+		return fmt.Errorf("%w %s", err, f.Type())
+	}
+	return err
+}
+
+// checkOneOf checks the values to be loaded into f against its oneof:"a,b"
+// tag, if any, as Enum does. With split, the values of a slice or an array are
+// split into their elements as loadFieldSlice does, to be checked one by one;
+// the values of a repeated option are elements already.
+func checkOneOf(f reflect.Value, vs []string, split bool, tag reflect.StructTag) error {
+	allowed, ok := tag.Lookup("oneof")
+	if !ok {
+		return nil
+	}
+	if k := f.Kind(); split && (k == reflect.Slice || k == reflect.Array) && f.Type().Elem().Kind() != reflect.Uint8 {
+		var elems []string
+		for _, v := range vs {
+			elems = append(elems, splitList(v, tag.Get("sep"))...)
+		}
+		vs = elems
+	}
+	for _, v := range vs {
+		if err := oneOf(v, splitList(allowed, ","), false); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (c *Config) loadFieldUint(f reflect.Value, sec string, opt string) error {
+// loadFieldValue sets f from the string v, as found in the configuration
+// or given by a "default" tag.
+func (c *Config) loadFieldValue(f reflect.Value, v string, tag reflect.StructTag) error {
+	if nv, ok, err := c.parseType(f.Type(), v); ok {
+		if err != nil {
+			return err
+		}
+		f.Set(nv)
+		return nil
+	}
+	// A pointer is only allocated once there is a value, so that a missing
+	// option leaves it nil.
+	if f.Kind() == reflect.Ptr {
+		p := reflect.New(f.Type().Elem())
+		if err := c.loadFieldValue(p.Elem(), v, tag); err != nil {
+			return err
+		}
+		f.Set(p)
+		return nil
+	}
+	// time.Time is a struct, so it has to be told apart by its type.
+	if f.Type() == timeType {
+		return c.loadFieldTime(f, v, tag.Get("layout"))
+	}
+	if f.Type() == urlType {
+		u, err := parseURL(v, tag.Get("scheme"))
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(*u))
+		return nil
+	}
+	// net.IP parses itself (see below), but net.IPNet does not.
+	if f.Type() == ipNetType {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return err
+		}
+		f.Set(reflect.ValueOf(*ipNet))
+		return nil
+	}
+	// As in encoding/json, a type which can parse itself does so; this
+	// comes before the slices for types such as net.IP.
+	if f.CanAddr() && f.Addr().Type().Implements(textUnmarshalerType) {
+		return f.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(v))
+	}
+	// A []byte holds the value itself, not a list of numbers.
+	if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8 {
+		f.SetBytes([]byte(v))
+		return nil
+	}
+	if f.Kind() == reflect.Slice {
+		return c.loadFieldSlice(f, v, tag.Get("sep"))
+	}
+	if f.Kind() == reflect.Array {
+		return c.loadFieldArray(f, v, tag.Get("sep"))
+	}
+	// A map named with an option is read from its value, as by StringMap.
+	if f.Kind() == reflect.Map {
+		return c.loadFieldPairs(f, v, tag.Get("sep"), tag.Get("kvsep"))
+	}
+	if tag.Get("bytes") == "true" {
+		return setBytes(f, v)
+	}
 
-	i, err := c.Int(sec, opt)
+	nv, err := c.transvalue(f.Type(), v)
 	if err != nil {
 		return err
 	}
-	f.SetUint(uint64(i))
+	f.Set(nv)
 	return nil
 }
 
-func (c *Config) loadFieldBool(f reflect.Value, sec string, opt string) error {
+// loadFieldTime parses the value with the given layout, which defaults to
+// time.RFC3339 when empty.
+func (c *Config) loadFieldTime(f reflect.Value, v string, layout string) error {
+	if layout == "" {
+		layout = time.RFC3339
+	}
+
+	tm, err := time.Parse(layout, v)
+	if err != nil {
+		return fmt.Errorf("could not parse time value with layout %q: %w", layout, err)
+	}
+	f.Set(reflect.ValueOf(tm))
+	return nil
+}
 
-	i, err := c.Bool(sec, opt)
+// parseInt parses s as an integer of the given bit size with the syntax of Go
+// integer literals: a "0b", "0o" (or just "0") or "0x" prefix selects base 2,
+// 8 or 16 instead of 10, and underscores may separate digits, as in
+// "1_000_000". The DigitSeparator, if set, is removed first; see ungroup.
+func (c *Config) parseInt(s string, bitSize int) (int64, error) {
+	s, err := c.ungroup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 0, bitSize)
+}
+
+// parseUint is like parseInt but for unsigned integers.
+func (c *Config) parseUint(s string, bitSize int) (uint64, error) {
+	s, err := c.ungroup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(s, 0, bitSize)
+}
+
+// atoi is parseInt for an int.
+func (c *Config) atoi(s string) (int, error) {
+	i, err := c.parseInt(s, strconv.IntSize)
+	return int(i), err
+}
+
+// ungroup removes the DigitSeparator from s. After the sign, the separator
+// must split the digits into a first group of one to three and then groups
+// of exactly three, as in "1,000,000"; anything else, such as "1,2,3" or
+// ",5,", is a syntax error.
+func (c *Config) ungroup(s string) (string, error) {
+	if c.DigitSeparator == "" || !strings.Contains(s, c.DigitSeparator) {
+		return s, nil
+	}
+	groups := strings.Split(strings.TrimLeft(s, "+-"), c.DigitSeparator)
+	for i, g := range groups {
+		if i == 0 && (len(g) == 0 || len(g) > 3) || i > 0 && len(g) != 3 {
+			return "", &strconv.NumError{Func: "ParseInt", Num: s, Err: strconv.ErrSyntax}
+		}
+	}
+	return strings.ReplaceAll(s, c.DigitSeparator, ""), nil
+}
+
+// byteUnits are the multipliers of the units accepted by parseBytes, indexed
+// by their lower case name.
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// parseBytes parses a byte size: a number, possibly with a fraction, followed
+// by an optional SI (KB, MB, GB, TB) or IEC (KiB, MiB, GiB, TiB) unit. Units
+// are case insensitive and a bare number is a number of bytes. Sizes are never
+// negative.
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != '-' && r != '+'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	num, unit := s[:i], strings.TrimSpace(s[i:])
+
+	mul, ok := byteUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("unknown byte size unit %q in %q", unit, s)
+	}
+	if strings.HasPrefix(num, "-") {
+		return 0, fmt.Errorf("negative byte size %q", s)
+	}
+
+	// Without a fraction the number is exact, even above 2^53.
+	if !strings.Contains(num, ".") {
+		n, err := strconv.ParseInt(num, 10, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return 0, fmt.Errorf("invalid byte size %q", s)
+		}
+		if m := int64(mul); err != nil || n > math.MaxInt64/m {
+			return 0, fmt.Errorf("byte size %q out of range", s)
+		}
+		return n * int64(mul), nil
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	n *= mul
+	if n >= math.MaxInt64 || n <= math.MinInt64 {
+		return 0, fmt.Errorf("byte size %q out of range", s)
+	}
+	return int64(n), nil
+}
+
+// setBytes sets the integer field f from the byte size v, as asked by a
+// bytes:"true" tag.
+func setBytes(f reflect.Value, v string) error {
+	n, err := parseBytes(v)
 	if err != nil {
 		return err
 	}
-	f.SetBool(i)
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f.OverflowInt(n) {
+			return fmt.Errorf("byte size %q out of range for %s", v, f.Type())
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 || f.OverflowUint(uint64(n)) {
+			return fmt.Errorf("byte size %q out of range for %s", v, f.Type())
+		}
+		f.SetUint(uint64(n))
+	default:
+		return ErrUnsupportedType
+	}
 	return nil
 }
-func (c *Config) transvalue(kind reflect.Kind, v string) (reflect.Value, error) {
-	switch kind {
-	case reflect.String:
-		return reflect.ValueOf(v), nil
 
+// transvalue converts v to a value of type t. Bools are read as by Bool, so
+// the strings added by RegisterBoolValues are accepted too, the types
+// registered by RegisterType are parsed by their parser, and the types which
+// implement encoding.TextUnmarshaler parse themselves, as fields do.
+func (c *Config) transvalue(t reflect.Type, v string) (reflect.Value, error) {
+	if nv, ok, err := c.parseType(t, v); ok {
+		return nv, err
+	}
+	// time.Duration is an int64, so it has to be told apart by its type.
+	if t == durationType {
+		d, err := time.ParseDuration(v)
+		return reflect.ValueOf(d), err
+	}
+	if t == colorType {
+		rgba, err := parseColor(v)
+		return reflect.ValueOf(rgba), err
+	}
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		nv := reflect.New(t)
+		if err := nv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(v)); err != nil {
+			return reflect.Value{}, err
+		}
+		return nv.Elem(), nil
+	}
+
+	var nv interface{}
+	var err error
+
+	switch t.Kind() {
+	case reflect.String:
+		nv = v
 	case reflect.Bool:
-		i, ok := boolString[strings.ToLower(v)]
+		i, ok := c.boolValue(v)
 		if !ok {
-			return reflect.ValueOf(false), errors.New("could not parse bool value: " + v)
+			return reflect.Value{}, errors.New("could not parse bool value: " + v)
 		}
-		return reflect.ValueOf(i), nil
+		nv = i
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		i, err := strconv.Atoi(v)
-		return reflect.ValueOf(i), err
+		// Parsed with the size of t, so that out of range values are
+		// reported instead of wrapping around in Convert.
+		nv, err = c.parseInt(v, t.Bits())
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		i, err := strconv.Atoi(v)
-		return reflect.ValueOf(uint64(i)), err
-	case reflect.Float32:
-		f, err := strconv.ParseFloat(v, 32)
-		return reflect.ValueOf(float32(f)), err
-	case reflect.Float64:
-		f, err := strconv.ParseFloat(v, 64)
-		return reflect.ValueOf(float64(f)), err
+		nv, err = c.parseUint(v, t.Bits())
+	case reflect.Float32, reflect.Float64:
+		nv, err = strconv.ParseFloat(v, t.Bits())
+	case reflect.Complex64, reflect.Complex128:
+		nv, err = strconv.ParseComplex(v, t.Bits())
+	default:
+		return reflect.Value{}, ErrUnsupportedType
 	}
-	return reflect.ValueOf(nil), ErrUnsupportedType
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return reflect.ValueOf(nv).Convert(t), nil
 }
-func (c *Config) loadFieldSlice(f reflect.Value, sec string, opt string) error {
 
-	v, err := c.String(sec, opt)
-	if err != nil {
-		return err
+// loadFieldSlice converts each element of the list in the value; see
+// splitList. The values of a repeated option are not split, see loadOption.
+//
+// A slice of structs is read as a grid, e.g. "/a, handlerA; /b, handlerB":
+// the rows are split on sep, which defaults to a semicolon here, and then
+// each row on commas; see loadFieldRow.
+func (c *Config) loadFieldSlice(f reflect.Value, v string, sep string) error {
+	if sep == "" && c.isRow(f.Type().Elem()) {
+		sep = ";"
 	}
+	return c.loadFieldList(f, splitList(v, sep))
+}
 
+// loadFieldList sets the slice f to the elements of ss, converted.
+func (c *Config) loadFieldList(f reflect.Value, ss []string) error {
 	e := f.Type().Elem()
-	ss := strings.Split(v, ",")
 	newv := reflect.MakeSlice(f.Type(), len(ss), len(ss))
 	for i := 0; i < len(ss); i++ {
-		v, err := c.transvalue(e.Kind(), ss[i])
+		if c.isRow(e) {
+			if err := c.loadFieldRow(newv.Index(i), ss[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		v, err := c.transvalue(e, ss[i])
+		if err != nil {
+			return err
+		}
+		newv.Index(i).Set(v)
+	}
+	f.Set(newv)
+	return nil
+}
+
+// isRow reports whether t is a struct loaded by loadFieldRow, that is one
+// which is not parsed as a single value, by itself or by RegisterType.
+func (c *Config) isRow(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct || t == timeType || t == urlType || t == ipNetType || t == colorType ||
+		reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.types[t]
+	return !ok
+}
+
+// loadFieldRow sets the struct f from the comma separated fields of the row,
+// which go to the exported fields of the struct in the order of declaration,
+// leaving out those tagged config:"-". The number of fields must match
+// exactly. The tags of a field, such as "layout", apply to its value.
+func (c *Config) loadFieldRow(f reflect.Value, row string) error {
+	ss := strings.Split(row, ",")
+	t := f.Type()
+	n := 0
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() || sf.Tag.Get("config") == "-" {
+			continue
+		}
+		if n < len(ss) {
+			if err := c.loadFieldValue(f.Field(i), strings.TrimSpace(ss[n]), sf.Tag); err != nil {
+				return fmt.Errorf("field %s of %q: %w", sf.Name, row, err)
+			}
+		}
+		n++
+	}
+	if n != len(ss) {
+		return fmt.Errorf("expected %d fields, got %d in %q", n, len(ss), row)
+	}
+	return nil
+}
+
+// loadFieldArray is loadFieldSlice for an array, whose length the list must
+// match exactly.
+func (c *Config) loadFieldArray(f reflect.Value, v string, sep string) error {
+	ss := splitList(v, sep)
+	if len(ss) != f.Len() {
+		return fmt.Errorf("expected %d elements, got %d", f.Len(), len(ss))
+	}
+
+	e := f.Type().Elem()
+	newv := reflect.New(f.Type()).Elem()
+	for i := 0; i < len(ss); i++ {
+		v, err := c.transvalue(e, ss[i])
 		if err != nil {
 			return err
 		}
@@ -295,55 +1319,313 @@ func (c *Config) loadFieldSlice(f reflect.Value, sec string, opt string) error {
 	f.Set(newv)
 	return nil
 }
-func (c *Config) loadFieldMap(f reflect.Value, sec string, opt string) error {
 
-	opts, err := c.Options(sec)
+// loadFieldMap fills a map with every option of the section, converting both
+// option names and values to the map's key and element types. It returns
+// ErrNotFound if the section does not exist, and a FieldError naming the
+// option if one does not convert.
+func (c *Config) loadFieldMap(f reflect.Value, sec string) error {
+	opts, err := c.SectionOptions(sec)
 	if err != nil {
-		return err
+		return ErrNotFound
 	}
-	fmt.Printf(" %s %v %v", sec, f.IsNil(), f.CanSet())
-	//e := f.Type().Elem()
 
 	newv := reflect.MakeMap(f.Type())
+	k := newv.Type().Key()
 	e := newv.Type().Elem()
 	for i := 0; i < len(opts); i++ {
+		// The errors name the option, that is the key at fault.
 		optv, err := c.String(sec, opts[i])
 		if err != nil {
-			return err
+			return &FieldError{Section: sec, Option: opts[i], Kind: reflect.Map, Err: err}
 		}
-		v, err := c.transvalue(e.Kind(), optv)
+		key, err := c.transvalue(k, opts[i])
 		if err != nil {
-			return err
+			return &FieldError{Section: sec, Option: opts[i], Kind: reflect.Map,
+				Err: fmt.Errorf("invalid key: %w", err)}
+		}
+		v, err := c.transvalue(e, optv)
+		if err != nil {
+			return &FieldError{Section: sec, Option: opts[i], Kind: reflect.Map, Err: err}
 		}
-		newv.SetMapIndex(reflect.ValueOf(opts[i]), v)
+		newv.SetMapIndex(key, v)
 	}
 	f.Set(newv)
 	return nil
 }
 
-func (c *Config) loadFieldString(f reflect.Value, sec string, opt string) error {
-
-	i, err := c.String(sec, opt)
+// loadFieldPairs fills a map from the key/value pairs in the value, converted
+// to the map's key and element types; see splitPairs.
+func (c *Config) loadFieldPairs(f reflect.Value, v string, pairSep string, kvSep string) error {
+	pairs, err := splitPairs(v, pairSep, kvSep)
 	if err != nil {
 		return err
 	}
-	f.SetString(i)
+
+	newv := reflect.MakeMapWithSize(f.Type(), len(pairs))
+	k := newv.Type().Key()
+	e := newv.Type().Elem()
+	for pk, pv := range pairs {
+		key, err := c.transvalue(k, pk)
+		if err != nil {
+			return fmt.Errorf("invalid key %q: %w", pk, err)
+		}
+		v, err := c.transvalue(e, pv)
+		if err != nil {
+			return fmt.Errorf("invalid value of %q: %w", pk, err)
+		}
+		newv.SetMapIndex(key, v)
+	}
+	f.Set(newv)
+	return nil
+}
+
+// isStructSlice reports whether t is a slice of structs, other than time.Time.
+func isStructSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct && t.Elem() != timeType
+}
+
+// nilPromoted reports whether the method of the struct v with the given name
+// is promoted from an embedded pointer which is nil, e.g. an optional block
+// left out (see loadFieldStructPtr), so that calling it would dereference
+// nil. The fields are looked up in order rather than by depth, and a method
+// which v declares itself next to such a field is taken for the promoted one.
+func nilPromoted(v reflect.Value, name string) bool {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).Anonymous {
+			continue
+		}
+		f := v.Field(i)
+		switch ft := f.Type(); {
+		case ft.Kind() == reflect.Ptr:
+			if _, ok := ft.MethodByName(name); !ok {
+				continue
+			}
+			if f.IsNil() {
+				return true
+			}
+			return ft.Elem().Kind() == reflect.Struct && nilPromoted(f.Elem(), name)
+		case ft.Kind() == reflect.Struct:
+			if _, ok := reflect.PtrTo(ft).MethodByName(name); ok {
+				return nilPromoted(f, name)
+			}
+		}
+	}
+	return false
+}
+
+// isStructPtr reports whether t is a pointer to a struct loaded field by field,
+// see loadFieldStructPtr.
+func (c *Config) isStructPtr(t reflect.Type) bool {
+	return t.Kind() == reflect.Ptr && c.isRow(t.Elem())
+}
+
+// loadFieldStructPtr sets the pointer f to a new struct loaded from the
+// section as by loadStruct, but only if at least one of the options its
+// fields ask for is present in the configuration, outside of the default
+// section: otherwise f is left nil, or as it was, and the errors, such as
+// those of required options, are dropped. An optional block of options can so
+// be told apart from one left to its defaults.
+func (c *Config) loadFieldStructPtr(f reflect.Value, section string, byName bool, used usedKeys) error {
+	p := reflect.New(f.Type().Elem())
+	asked := make(usedKeys)
+	err := c.loadStruct(p.Elem(), section, byName, asked)
+
+	present := false
+	c.mu.RLock()
+	for sec, options := range asked {
+		for opt := range options {
+			used.add(sec, opt)
+			if _, ok := c.data[sec]; ok && sec != DEFAULT_SECTION {
+				_, found := c.data[sec][opt]
+				present = present || found || opt == ""
+			}
+		}
+	}
+	c.mu.RUnlock()
+
+	if !present {
+		return nil
+	}
+	f.Set(p)
+	return err
+}
+
+// loadFieldSections fills a slice of structs with one element per section
+// whose name matches the pattern, as in path.Match (e.g. "server*"). The
+// elements follow the sorted order of the section names, and each one is
+// loaded as a struct whose tags leave out the section (":option"). The default
+// section never matches.
+func (c *Config) loadFieldSections(f reflect.Value, pattern string, used usedKeys) error {
+	var sections []string
+	for _, s := range c.Sections() {
+		ok, err := path.Match(pattern, s)
+		if err != nil {
+			return fmt.Errorf("invalid section pattern %q: %w", pattern, err)
+		}
+		if ok && s != DEFAULT_SECTION {
+			sections = append(sections, s)
+		}
+	}
+	if len(sections) == 0 {
+		return ErrNotFound
+	}
+	sort.Strings(sections)
+
+	newv := reflect.MakeSlice(f.Type(), len(sections), len(sections))
+	for i, s := range sections {
+		if err := c.loadStruct(newv.Index(i), s, false, used); err != nil {
+			return err
+		}
+	}
+	f.Set(newv)
 	return nil
 }
+
+// pickAlias returns the first of the option and its comma separated aliases
+// which is present in the section, or the option if none is. The aliases are
+// options of the same section, named alone, dashes and dots included (e.g.
+// "old-host"), or after the section and a colon, e.g. "db:hostname" or
+// ":hostname" for section db. They are recorded in used.
+func (c *Config) pickAlias(sec string, opt string, aliases string, used usedKeys) (string, error) {
+	names := []string{opt}
+	for _, alias := range strings.Split(aliases, ",") {
+		alias = strings.TrimSpace(alias)
+		if alias == "" {
+			continue
+		}
+		if i := strings.LastIndex(alias, ":"); i != -1 {
+			s, o := strings.TrimSpace(alias[:i]), strings.TrimSpace(alias[i+1:])
+			if o == "" {
+				return "", fmt.Errorf("alias %q names no option", alias)
+			}
+			if s != "" && c.sectionKey(s) != c.sectionKey(sec) {
+				return "", fmt.Errorf("alias %q not in section %s", alias, sec)
+			}
+			alias = o
+		}
+		names = append(names, alias)
+		used.add(c.sectionKey(sec), c.optionKey(alias))
+	}
+
+	for _, name := range names {
+		if _, err := c.RawString(sec, name); err == nil {
+			return name, nil
+		}
+	}
+	return opt, nil
+}
+
+// usedKeys records the options asked for by the fields of a struct, by section
+// and option name. An empty option name stands for the whole section, as read
+// into a map.
+type usedKeys map[string]map[string]bool
+
+func (u usedKeys) add(section, option string) {
+	if u[section] == nil {
+		u[section] = make(map[string]bool)
+	}
+	u[section][option] = true
+}
+
+func (u usedKeys) has(section, option string) bool {
+	return u[section][""] || u[section][option]
+}
+
+// checkUnused returns an error listing the options, outside of the default
+// section, which are not in used.
+func (c *Config) checkUnused(used usedKeys) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var unused []string
+	for _, section := range c.sections() {
+		if section == DEFAULT_SECTION {
+			continue
+		}
+		for _, option := range c.orderedOptions(section) {
+			if !used.has(section, option) {
+				unused = append(unused, fmt.Sprintf("[%s] %s", section, option))
+			}
+		}
+	}
+	if len(unused) > 0 {
+		return fmt.Errorf("unknown options: %s", strings.Join(unused, ", "))
+	}
+	return nil
+}
+
+// isNotFound reports whether err means that the option being loaded is not
+// present, in which case the field keeps its current value.
+func isNotFound(err error) bool {
+	if err == ErrNotFound {
+		return true
+	}
+	switch err.(type) {
+	case OptionError, SectionError:
+		return true
+	}
+	return false
+}
+
+// snakeCase converts a Go field name to snake case: words are split before an
+// upper case letter which follows a lower case letter or a digit, or which
+// starts a word after an acronym, and then lower cased. So "MaxConns" becomes
+// "max_conns", "HTTPPort" "http_port" and "Retry2Count" "retry2_count".
+func snakeCase(name string) string {
+	var buf strings.Builder
+	rs := []rune(name)
+	for i, r := range rs {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := rs[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				unicode.IsUpper(prev) && i+1 < len(rs) && unicode.IsLower(rs[i+1]) {
+				buf.WriteByte('_')
+			}
+		}
+		buf.WriteRune(unicode.ToLower(r))
+	}
+	return buf.String()
+}
+
+// fieldName returns the section and option named by the "config" tag of f.
+//
+// The preferred form is "section:option", split at the last colon so that the
+// section name may contain dashes (or colons). Otherwise a tag with a dot is
+// read in the dotted "section.option" form, split at the last dot so that the
+// section name may contain dots and dashes and the option name dashes
+// ("my-service.pool-size"). A tag with neither is read in the legacy
+// "section-option" form, split at the first dash so that the option name may
+// contain dashes. The split depends only on the tag, so a legacy option whose
+// name contains a dot must be written in the colon form ("db:pool.size", not
+// "db-pool.size"). A tag with none of them names a whole section, and so does
+// "section:"; a tag ":option" leaves the section out (see loadStruct).
 func fieldName(f reflect.StructField) (string, string) {
 	if f.Anonymous {
 		return "", ""
 	}
 	tag := f.Tag.Get("config")
-	if tag != "" {
-		if tag == "-" {
-			return "", ""
-		}
-		tagParts := strings.Split(tag, "-")
-		if len(tagParts) > 1 {
-			return strings.TrimSpace(tagParts[0]), strings.TrimSpace(tagParts[1])
-		}
-		return strings.TrimSpace(tagParts[0]), ""
+	if tag == "" || tag == "-" {
+		return "", ""
+	}
+	return splitTag(tag)
+}
+
+// splitTag splits a non-empty "config" tag into section and option, as
+// described in fieldName.
+func splitTag(tag string) (string, string) {
+	split := func(i int) (string, string) {
+		return strings.TrimSpace(tag[:i]), strings.TrimSpace(tag[i+1:])
+	}
+	if i := strings.LastIndex(tag, ":"); i != -1 {
+		return split(i)
+	}
+	if i := strings.LastIndex(tag, "."); i != -1 {
+		return split(i)
+	}
+	if i := strings.Index(tag, "-"); i != -1 {
+		return split(i)
 	}
-	return "", ""
+	return strings.TrimSpace(tag), ""
 }
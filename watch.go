@@ -0,0 +1,112 @@
+// Copyright 2009  The "config" Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// watchInterval is how often WatchFile checks the file.
+var watchInterval = time.Second
+
+// errChanged is returned by reload when the file changed while it was read.
+var errChanged = errors.New("config: file changed while reading")
+
+// WatchFile checks the file every second and, when its modification time or
+// size changes, reads it again and replaces the options of the configuration
+// with ReplaceData, so readers never see a partial reload. The file is read
+// with the settings of the configuration. onReload, if not nil, is called
+// after each reload with the error reading the file, or nil; on error the
+// options are left as they were. A file that changes while it is read is
+// read again on the next check.
+//
+// It returns an error if the file cannot be found. The returned function
+// stops watching, and returns once the watcher is done.
+func (c *Config) WatchFile(fname string, onReload func(error)) (stop func(), err error) {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+
+		mod, size := fi.ModTime(), fi.Size()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			fi, err := os.Stat(fname)
+			if err == nil && fi.ModTime().Equal(mod) && fi.Size() == size {
+				continue
+			}
+			if err == nil {
+				mod, size = fi.ModTime(), fi.Size()
+				err = c.reload(fname, fi)
+				if err == errChanged {
+					continue
+				}
+			}
+			if onReload != nil {
+				onReload(err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}, nil
+}
+
+// reload reads the file into an empty configuration with the same settings,
+// and replaces the options with those read. fi is the state of the file
+// before reading; if the file is no longer the same once read, it may have
+// been read half-written, so the options are left alone and errChanged is
+// returned.
+func (c *Config) reload(fname string, fi os.FileInfo) error {
+	fresh := c.Clone()
+	fresh.data = make(map[string]map[string]*tValue)
+	fresh.idSection = make(map[string]int)
+	fresh.lastIdSection = 0
+	fresh.lastIdOption = make(map[string]int)
+	fresh.sectionComments = nil
+	fresh.trailer = nil
+	fresh.AddSection(DEFAULT_SECTION)
+
+	if _, err := _read(fname, fresh); err != nil {
+		return err
+	}
+	after, err := os.Stat(fname)
+	if err != nil {
+		return err
+	}
+	if !after.ModTime().Equal(fi.ModTime()) || after.Size() != fi.Size() {
+		return errChanged
+	}
+	c.ReplaceData(fresh)
+	return nil
+}
@@ -16,9 +16,13 @@ package config
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"strings"
+	"unicode"
 )
 
 // WriteFile saves the configuration representation to a file.
@@ -31,7 +35,10 @@ func (c *Config) WriteFile(fname string, perm os.FileMode, header string) error
 	}
 
 	buf := bufio.NewWriter(file)
-	if err = c.write(buf, header); err != nil {
+	c.mu.RLock()
+	err = c.write(buf, header)
+	c.mu.RUnlock()
+	if err != nil {
 		return err
 	}
 	buf.Flush()
@@ -39,6 +46,125 @@ func (c *Config) WriteFile(fname string, perm os.FileMode, header string) error
 	return file.Close()
 }
 
+// WriteTo writes the configuration representation to w, in the same format
+// as WriteFile but without a header. Sections and options follow their input
+// order and values are written raw, so reading the output back yields an
+// equivalent configuration. It implements io.WriterTo.
+func (c *Config) WriteTo(w io.Writer) (n int64, err error) {
+	cw := &countWriter{w: w}
+	buf := bufio.NewWriter(cw)
+
+	c.mu.RLock()
+	err = c.write(buf, "")
+	c.mu.RUnlock()
+	if err == nil {
+		err = buf.Flush()
+	}
+
+	return cw.n, err
+}
+
+// DumpString renders the configuration as WriteTo does, for inspection. The
+// values of the options whose name matches one of the sensitive patterns,
+// such as "*password*" (see path.Match; case is ignored), are replaced by
+// "****". (It cannot be named String, which is taken by the getter.)
+func (c *Config) DumpString(sensitive ...string) string {
+	src := c
+	if len(sensitive) > 0 {
+		src = c.Clone()
+		for _, options := range src.data {
+			for option, tValue := range options {
+				for _, pattern := range sensitive {
+					if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(option)); ok {
+						// write prints every value of a repeated option.
+						tValue.v = "****"
+						for i := range tValue.vs {
+							tValue.vs[i] = "****"
+						}
+						break
+					}
+				}
+			}
+		}
+	}
+
+	var buf strings.Builder
+	src.WriteTo(&buf)
+	return buf.String()
+}
+
+// MarshalJSON encodes the configuration as a JSON object with a member per
+// section (the default one under DEFAULT_SECTION), each an object with the
+// raw values of its options. Members are sorted by name. It implements
+// json.Marshaler.
+func (c *Config) MarshalJSON() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	m := make(map[string]map[string]string, len(c.data))
+	for section, options := range c.data {
+		m[section] = make(map[string]string, len(options))
+		for option, tValue := range options {
+			m[section][option] = tValue.v
+		}
+	}
+	return json.Marshal(m)
+}
+
+// WriteProperties writes the configuration in the format of Java .properties
+// files, as "section.option=value" lines; the options of the default section
+// have no section prefix. Sections and options follow their input order,
+// values are written raw (the last one of a repeated option), and the
+// backslashes, '=', ':' and line breaks in keys and values are escaped, as are
+// the spaces of the keys and the leading spaces of the values.
+func (c *Config) WriteProperties(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, section := range c.sections() {
+		prefix := section + "."
+		if section == DEFAULT_SECTION {
+			prefix = ""
+		}
+		for _, option := range c.orderedOptions(section) {
+			key := escapeProperty(prefix+option, true)
+			value := escapeProperty(c.data[section][option].v, false)
+			if _, err := buf.WriteString(key + "=" + value + "\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return buf.Flush()
+}
+
+// propertyReplacer escapes the characters special in .properties files.
+var propertyReplacer = strings.NewReplacer(
+	"\\", "\\\\", "=", "\\=", ":", "\\:", "\n", "\\n", "\r", "\\r", "\t", "\\t")
+
+// escapeProperty escapes s as a key or a value of a .properties file.
+func escapeProperty(s string, key bool) string {
+	s = propertyReplacer.Replace(s)
+	if key {
+		return strings.Replace(s, " ", "\\ ", -1)
+	}
+	trimmed := strings.TrimLeft(s, " ")
+	return strings.Repeat("\\ ", len(s)-len(trimmed)) + trimmed
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
 func (c *Config) write(buf *bufio.Writer, header string) (err error) {
 	if header != "" {
 		// Add comment character after of each new line.
@@ -51,7 +177,7 @@ func (c *Config) write(buf *bufio.Writer, header string) (err error) {
 		}
 	}
 
-	for _, orderedSection := range c.Sections() {
+	for _, orderedSection := range c.sections() {
 		for section, sectionMap := range c.data {
 			if section == orderedSection {
 
@@ -60,7 +186,13 @@ func (c *Config) write(buf *bufio.Writer, header string) (err error) {
 					continue
 				}
 
-				if _, err = buf.WriteString("\n[" + section + "]\n"); err != nil {
+				// The lines kept before the header replace the blank
+				// line between sections.
+				header := "\n[" + section + "]\n"
+				if lines, ok := c.sectionComments[section]; ok {
+					header = joinLines(lines) + "[" + section + "]\n"
+				}
+				if _, err = buf.WriteString(header); err != nil {
 					return err
 				}
 
@@ -69,11 +201,20 @@ func (c *Config) write(buf *bufio.Writer, header string) (err error) {
 					for option, tValue := range sectionMap {
 
 						if tValue.position == i {
-							if _, err = buf.WriteString(fmt.Sprint(
-								option, c.separator, tValue.v, "\n")); err != nil {
+							// A repeated option is written once per value.
+							values := tValue.vs
+							if values == nil {
+								values = []string{tValue.v}
+							}
+							if _, err = buf.WriteString(joinLines(tValue.comments)); err != nil {
 								return err
 							}
-							c.RemoveOption(section, option)
+							for _, v := range values {
+								if _, err = buf.WriteString(fmt.Sprint(
+									option, c.separator, formatValue(v, c.commentChars()), "\n")); err != nil {
+									return err
+								}
+							}
 							break
 						}
 					}
@@ -82,9 +223,78 @@ func (c *Config) write(buf *bufio.Writer, header string) (err error) {
 		}
 	}
 
-	if _, err = buf.WriteString("\n"); err != nil {
+	trailer := "\n"
+	if c.trailer != nil {
+		trailer = joinLines(c.trailer)
+	}
+	if _, err = buf.WriteString(trailer); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// joinLines returns the lines, each followed by a new line.
+func joinLines(lines []string) string {
+	var buf strings.Builder
+	for _, l := range lines {
+		buf.WriteString(l + "\n")
+	}
+	return buf.String()
+}
+
+// formatValue returns v as written in a file: the lines of a multi-line value
+// are indented so they are read back as a continuation, and the characters in
+// chars which would start a comment are escaped with a backslash (see
+// stripComments). Values with significant spaces at either end, or a line
+// ending with a backslash, are quoted instead.
+func formatValue(v string, chars string) string {
+	if needsQuotes(v, chars) {
+		return quoteValue(v)
+	}
+
+	var buf strings.Builder
+	for i := 0; i < len(v); i++ {
+		ch := v[i]
+		if strings.IndexByte(chars, ch) != -1 && (i == 0 || v[i-1] == ' ' || v[i-1] == '\t' || v[i-1] == '\n') {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(ch)
+		if ch == '\n' {
+			buf.WriteByte('\t')
+		}
+	}
+	return buf.String()
+}
+
+// quoteValue is the reverse of unquoteValue, for the values which would not
+// be read back as they are otherwise.
+func quoteValue(v string) string {
+	r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t")
+	return "\"" + r.Replace(v) + "\""
+}
+
+// needsQuotes reports whether v must be quoted to keep its surrounding spaces
+// or quotes, the backslashes which would join its lines to the next ones or
+// be taken for the escape of a comment character in chars, or the leading
+// spaces and empty lines after its line breaks, which are lost when the
+// continuation lines are read back.
+func needsQuotes(v string, chars string) bool {
+	if strings.TrimSpace(v) != v || len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		return true
+	}
+	for i := 0; i+1 < len(v); i++ {
+		if v[i] == '\\' && strings.IndexByte(chars, v[i+1]) != -1 {
+			return true
+		}
+	}
+	for i, l := range strings.Split(v, "\n") {
+		if strings.HasSuffix(strings.TrimRightFunc(l, unicode.IsSpace), "\\") {
+			return true
+		}
+		if i > 0 && (l == "" || strings.TrimLeftFunc(l, unicode.IsSpace) != l) {
+			return true
+		}
+	}
+	return false
+}